@@ -0,0 +1,533 @@
+package appconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/30Piraten/aws-dynamicEventBuilder/bootstrap"
+	"github.com/30Piraten/aws-dynamicEventBuilder/cost"
+	"github.com/30Piraten/aws-dynamicEventBuilder/policy"
+	"github.com/30Piraten/aws-dynamicEventBuilder/quota"
+	"github.com/30Piraten/aws-dynamicEventBuilder/redact"
+)
+
+// Config is the typed service configuration. It is loaded once at cold
+// start by Load and passed into every handler.
+type Config struct {
+	// Handler selects the Lambda handler the binary starts
+	Handler string `json:"handler"`
+
+	// Environment is the environment this deployment serves (dev, test, prod)
+	Environment string `json:"environment"`
+
+	// TrackingTableType and EventsTableType name the SSM parameters the
+	// table names are resolved from, see TableNameParameter
+	TrackingTableType string `json:"tracking_table_type"`
+	EventsTableType   string `json:"events_table_type"`
+
+	// TrackingTable and EventsTable are the DynamoDB table names. They are
+	// resolved from SSM when not configured directly.
+	TrackingTable string `json:"tracking_table"`
+	EventsTable   string `json:"events_table"`
+
+	// MetricsMode selects the metrics sink. When unset it is prometheus
+	// for the local server and api otherwise.
+	MetricsMode      string `json:"metrics_mode"`
+	MetricsNamespace string `json:"metrics_namespace"`
+
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+
+	// OwnerTag and ServiceTag are the Owner and Service tag values set on
+	// every provisioned instance. The caller's identity replaces OwnerTag
+	// when the request is authenticated. Drift detection recognises the
+	// instances it manages by the Service tag.
+	OwnerTag   string `json:"owner_tag"`
+	ServiceTag string `json:"service_tag"`
+
+	// WaitForRunning is how long provisioning waits for the instance to
+	// reach running. Zero skips the wait.
+	WaitForRunning time.Duration `json:"wait_for_running"`
+
+	// DriftMode is the remediation mode of the drift check, one of
+	// report, fix-state or reconcile, see monitordrift
+	DriftMode             string        `json:"drift_mode"`
+	DriftMaxChanges       int           `json:"drift_max_changes"`
+	DriftMaxChangePercent float64       `json:"drift_max_change_percent"`
+	DriftMinInspected     int           `json:"drift_min_inspected"`
+	DriftInterval         time.Duration `json:"drift_interval"`
+
+	// DriftOrphanGrace is how long an untracked instance is left alone
+	// after its launch, so an instance whose record is still being
+	// written is not taken for an orphan
+	DriftOrphanGrace time.Duration `json:"drift_orphan_grace"`
+
+	// SweepRegions are the regions the drift check lists for orphaned
+	// instances. Tracked instances are checked in their own region
+	// regardless. Empty sweeps the home region only.
+	SweepRegions []string `json:"sweep_regions"`
+
+	// AdminGroups may tear down, extend and pin environments they do not
+	// own
+	AdminGroups []string `json:"admin_groups"`
+
+	// ClientID is the team provision requests are counted against, the
+	// client_id of the Terraform deployment. Only admins may name another.
+	ClientID string `json:"client_id"`
+
+	// DefaultQuota applies to every team without an entry in TeamQuotas.
+	// A zero limit is unlimited, so the defaults are finite.
+	DefaultQuota quota.Limits            `json:"default_quota"`
+	TeamQuotas   map[string]quota.Limits `json:"team_quotas"`
+
+	// PolicyFile is a local file holding the provision policy of each
+	// environment. When unset the policies are read from SSM, see
+	// PolicyParameter.
+	PolicyFile string `json:"policy_file"`
+
+	// policies are the policies loaded from PolicyFile
+	policies map[string]*policy.Policy
+
+	// PriceTableFile replaces the embedded price table used for cost
+	// estimates, see the cost package
+	PriceTableFile string `json:"price_table_file"`
+
+	// BootstrapDir holds bootstrap templates that are added to, or
+	// replace, the embedded ones, see the bootstrap package
+	BootstrapDir string `json:"bootstrap_dir"`
+
+	// ParameterCacheTTL is how long values read from SSM are cached
+	ParameterCacheTTL time.Duration `json:"parameter_cache_ttl"`
+
+	// RedactFields and RedactPatterns are masked in log entries and
+	// error responses on top of the defaults of the redact package.
+	// Patterns are regular expressions.
+	RedactFields   []string `json:"redact_fields"`
+	RedactPatterns []string `json:"redact_patterns"`
+
+	// Endpoints overrides the AWS endpoints, e.g. to run against local
+	// stand-ins
+	Endpoints awsclient.Endpoints `json:"endpoints"`
+
+	// LocalAddr runs the service as a long-lived local server on this
+	// address instead of as a Lambda function
+	LocalAddr string `json:"local_addr"`
+}
+
+// Handlers the binary can start
+const (
+	HandlerProvision = "provision"
+	HandlerCleanup   = "cleanup"
+	HandlerDrift     = "drift"
+	HandlerInventory = "inventory"
+	HandlerHistory   = "history"
+	HandlerLifecycle = "lifecycle"
+
+	// HandlerSpotInterruption receives the EC2 spot interruption warnings
+	// EventBridge forwards
+	HandlerSpotInterruption = "spot-interruption"
+)
+
+// Defaults returns the configuration used before the file, environment
+// and SSM are applied
+func Defaults() Config {
+	return Config{
+		Handler:               HandlerProvision,
+		ClientID:              "default",
+		TrackingTableType:     "env-tracker",
+		EventsTableType:       "events",
+		MetricsNamespace:      "EC2ProvisioningMetrics",
+		LogLevel:              "info",
+		LogFormat:             "json",
+		OwnerTag:              "AutomationLambda",
+		ServiceTag:            "DynamicProvisioning",
+		DefaultQuota:          quota.Limits{MaxEnvironments: 10, MaxVCPUs: 64, MaxTTLHours: 168},
+		DriftMode:             "fix-state",
+		DriftMaxChanges:       20,
+		DriftMaxChangePercent: 50,
+		DriftMinInspected:     10,
+		DriftOrphanGrace:      15 * time.Minute,
+		ParameterCacheTTL:     defaultCacheTTL,
+	}
+}
+
+// Load builds the configuration from the defaults, the optional JSON file
+// named by CONFIG_FILE, the environment variables and finally SSM for the
+// table names that are still unset. The result is validated, so a missing
+// or malformed setting fails here rather than on the first request.
+func Load(ctx context.Context) (*Config, error) {
+	cfg := Defaults()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if cfg.MetricsMode == "" {
+		cfg.MetricsMode = "api"
+		if cfg.LocalAddr != "" {
+			cfg.MetricsMode = "prometheus"
+		}
+	}
+
+	// The table names below are already resolved through the overrides
+	awsclient.Configure(cfg.Endpoints)
+	defaultResolver.SetTTL(cfg.ParameterCacheTTL)
+	if err := redact.Configure(cfg.RedactFields, cfg.RedactPatterns); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err := cost.Configure(cfg.PriceTableFile); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err := bootstrap.Configure(cfg.BootstrapDir); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if cfg.PolicyFile != "" {
+		policies, err := policy.LoadFile(cfg.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+		cfg.policies = policies
+	}
+
+	if err := cfg.resolveTables(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// loadFile applies the settings of a JSON configuration file. Durations
+// are given as strings such as "90s".
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	// Durations are decoded from strings through this shadow struct
+	type alias Config
+	file := struct {
+		*alias
+		WaitForRunning string `json:"wait_for_running"`
+		DriftInterval  string `json:"drift_interval"`
+		OrphanGrace    string `json:"drift_orphan_grace"`
+		CacheTTL       string `json:"parameter_cache_ttl"`
+	}{alias: (*alias)(c)}
+
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	for _, d := range []struct {
+		value  string
+		target *time.Duration
+		name   string
+	}{
+		{file.WaitForRunning, &c.WaitForRunning, "wait_for_running"},
+		{file.DriftInterval, &c.DriftInterval, "drift_interval"},
+		{file.OrphanGrace, &c.DriftOrphanGrace, "drift_orphan_grace"},
+		{file.CacheTTL, &c.ParameterCacheTTL, "parameter_cache_ttl"},
+	} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q in config file %s", d.name, d.value, path)
+		}
+		*d.target = parsed
+	}
+
+	return nil
+}
+
+// loadEnv applies the settings given as environment variables
+func (c *Config) loadEnv() error {
+	for name, target := range map[string]*string{
+		"HANDLER":                 &c.Handler,
+		"ENVIRONMENT":             &c.Environment,
+		"TABLE_TYPE":              &c.TrackingTableType,
+		"EVENTS_TABLE_TYPE":       &c.EventsTableType,
+		"TABLE_NAME":              &c.TrackingTable,
+		"EVENTS_TABLE_NAME":       &c.EventsTable,
+		"METRICS_MODE":            &c.MetricsMode,
+		"METRICS_NAMESPACE":       &c.MetricsNamespace,
+		"LOG_LEVEL":               &c.LogLevel,
+		"LOG_FORMAT":              &c.LogFormat,
+		"OWNER_TAG":               &c.OwnerTag,
+		"SERVICE_TAG":             &c.ServiceTag,
+		"DRIFT_MODE":              &c.DriftMode,
+		"CLIENT_ID":               &c.ClientID,
+		"POLICY_FILE":             &c.PolicyFile,
+		"PRICE_TABLE_FILE":        &c.PriceTableFile,
+		"BOOTSTRAP_DIR":           &c.BootstrapDir,
+		"LOCAL_ADDR":              &c.LocalAddr,
+		"ENDPOINT_URL":            &c.Endpoints.Default,
+		"ENDPOINT_URL_EC2":        &c.Endpoints.EC2,
+		"ENDPOINT_URL_DYNAMODB":   &c.Endpoints.DynamoDB,
+		"ENDPOINT_URL_SSM":        &c.Endpoints.SSM,
+		"ENDPOINT_URL_CLOUDWATCH": &c.Endpoints.CloudWatch,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			*target = strings.TrimSpace(v)
+		}
+	}
+
+	// DEBUG=true is kept as a shorthand for LOG_LEVEL=debug
+	if os.Getenv("DEBUG") == "true" {
+		c.LogLevel = "debug"
+	}
+
+	for name, target := range map[string]*time.Duration{
+		"WAIT_FOR_RUNNING":    &c.WaitForRunning,
+		"DRIFT_INTERVAL":      &c.DriftInterval,
+		"DRIFT_ORPHAN_GRACE":  &c.DriftOrphanGrace,
+		"PARAMETER_CACHE_TTL": &c.ParameterCacheTTL,
+	} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", name, v, err)
+			}
+			*target = d
+		}
+	}
+
+	// Lists are comma separated, e.g. SWEEP_REGIONS="eu-west-1,us-east-1"
+	for name, target := range map[string]*[]string{
+		"SWEEP_REGIONS": &c.SweepRegions,
+		"ADMIN_GROUPS":  &c.AdminGroups,
+		"REDACT_FIELDS": &c.RedactFields,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*target = nil
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*target = append(*target, item)
+				}
+			}
+		}
+	}
+
+	// Patterns may contain commas, so they are separated by newlines
+	if v := os.Getenv("REDACT_PATTERNS"); v != "" {
+		c.RedactPatterns = nil
+		for _, p := range strings.Split(v, "\n") {
+			if p != "" {
+				c.RedactPatterns = append(c.RedactPatterns, p)
+			}
+		}
+	}
+
+	for name, target := range map[string]*int{
+		"QUOTA_MAX_ENVIRONMENTS": &c.DefaultQuota.MaxEnvironments,
+		"QUOTA_MAX_VCPUS":        &c.DefaultQuota.MaxVCPUs,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", name, v, err)
+			}
+			*target = n
+		}
+	}
+
+	if v := os.Getenv("QUOTA_MAX_TTL_HOURS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid QUOTA_MAX_TTL_HOURS %q: %w", v, err)
+		}
+		c.DefaultQuota.MaxTTLHours = n
+	}
+
+	for name, target := range map[string]*int{
+		"DRIFT_MAX_CHANGES":   &c.DriftMaxChanges,
+		"DRIFT_MIN_INSPECTED": &c.DriftMinInspected,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", name, v, err)
+			}
+			*target = n
+		}
+	}
+
+	if v := os.Getenv("DRIFT_MAX_CHANGE_PERCENT"); v != "" {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid DRIFT_MAX_CHANGE_PERCENT %q: %w", v, err)
+		}
+		c.DriftMaxChangePercent = p
+	}
+
+	return nil
+}
+
+// resolveTables resolves the table names that are not configured
+// directly from SSM
+func (c *Config) resolveTables(ctx context.Context) error {
+	if c.Environment == "" {
+		return fmt.Errorf("invalid configuration: ENVIRONMENT is required")
+	}
+
+	for _, t := range []struct {
+		tableType string
+		target    *string
+	}{
+		{c.TrackingTableType, &c.TrackingTable},
+		{c.EventsTableType, &c.EventsTable},
+	} {
+		if *t.target != "" {
+			continue
+		}
+
+		name, err := TableName(ctx, c.Environment, t.tableType)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s table name: %w", t.tableType, err)
+		}
+		*t.target = name
+	}
+
+	return nil
+}
+
+// environmentName matches the environment names the SSM parameter
+// paths are built from
+var environmentName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Validate reports the first setting that is missing or malformed
+func (c *Config) Validate() error {
+	switch c.Handler {
+	case HandlerProvision, HandlerCleanup, HandlerDrift, HandlerInventory, HandlerHistory, HandlerLifecycle, HandlerSpotInterruption:
+	default:
+		return fmt.Errorf("unknown handler %q", c.Handler)
+	}
+
+	if !environmentName.MatchString(c.Environment) {
+		return fmt.Errorf("environment %q must be lower case letters, digits and dashes", c.Environment)
+	}
+
+	if c.TrackingTable == "" {
+		return fmt.Errorf("tracking table name is required")
+	}
+	if c.EventsTable == "" {
+		return fmt.Errorf("events table name is required")
+	}
+
+	switch c.MetricsMode {
+	case "api", "emf", "prometheus":
+	default:
+		return fmt.Errorf("unknown metrics mode %q", c.MetricsMode)
+	}
+	if c.MetricsNamespace == "" {
+		return fmt.Errorf("metrics namespace is required")
+	}
+
+	switch c.LogLevel {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		return fmt.Errorf("unknown log level %q", c.LogLevel)
+	}
+	switch c.LogFormat {
+	case "json", "text":
+	default:
+		return fmt.Errorf("unknown log format %q", c.LogFormat)
+	}
+
+	if c.OwnerTag == "" || c.ServiceTag == "" {
+		return fmt.Errorf("owner and service tag values are required")
+	}
+
+	for _, url := range []string{c.Endpoints.Default, c.Endpoints.EC2, c.Endpoints.DynamoDB, c.Endpoints.SSM, c.Endpoints.CloudWatch} {
+		if url != "" && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return fmt.Errorf("endpoint %q must be an http or https URL", url)
+		}
+	}
+
+	if c.WaitForRunning < 0 || c.DriftInterval < 0 || c.DriftOrphanGrace < 0 || c.ParameterCacheTTL < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+
+	switch c.DriftMode {
+	case "report", "fix-state", "reconcile":
+	default:
+		return fmt.Errorf("unknown drift mode %q", c.DriftMode)
+	}
+	if c.DriftMaxChanges < 0 {
+		return fmt.Errorf("drift max changes must not be negative")
+	}
+	if c.DriftMaxChangePercent < 0 || c.DriftMaxChangePercent > 100 {
+		return fmt.Errorf("drift max change percent must be between 0 and 100")
+	}
+	if c.DriftMinInspected < 0 {
+		return fmt.Errorf("drift min inspected must not be negative")
+	}
+	for team, limits := range c.TeamQuotas {
+		if limits.MaxEnvironments < 0 || limits.MaxVCPUs < 0 || limits.MaxTTLHours < 0 {
+			return fmt.Errorf("quota of team %q must not be negative", team)
+		}
+	}
+	if c.DefaultQuota.MaxEnvironments < 0 || c.DefaultQuota.MaxVCPUs < 0 || c.DefaultQuota.MaxTTLHours < 0 {
+		return fmt.Errorf("default quota must not be negative")
+	}
+
+	for _, region := range c.SweepRegions {
+		if !awsclient.ValidRegion(region) {
+			return fmt.Errorf("unknown sweep region %q", region)
+		}
+	}
+
+	return nil
+}
+
+// QuotaFor returns the quota of a team
+func (c *Config) QuotaFor(team string) quota.Limits {
+	if limits, ok := c.TeamQuotas[team]; ok {
+		return limits
+	}
+	return c.DefaultQuota
+}
+
+// Policy returns the provision policy of an environment, from PolicyFile
+// when one is configured and from SSM otherwise. It returns nil when the
+// environment has no policy. The name goes into the parameter path, so
+// it has to be a valid environment name.
+func (c *Config) Policy(ctx context.Context, environment string) (*policy.Policy, error) {
+	if !environmentName.MatchString(environment) {
+		return nil, fmt.Errorf("invalid environment %q", environment)
+	}
+	if c.PolicyFile != "" {
+		return c.policies[environment], nil
+	}
+
+	value, err := defaultResolver.Get(ctx, environment, PolicyParameter(environment))
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return policy.Parse([]byte(value))
+}
@@ -0,0 +1,225 @@
+package appconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// ParameterPrefix is the root of every parameter the service reads
+const ParameterPrefix = "/project-r3"
+
+// defaultCacheTTL is how long resolved parameters are kept unless
+// ParameterCacheTTL is configured
+const defaultCacheTTL = 5 * time.Minute
+
+// cachedValue is a resolved parameter and when it expires
+type cachedValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+// Resolver resolves /project-r3/{env}/... parameters from SSM Parameter
+// Store. Values are cached in process for the TTL, and the first lookup
+// for an environment loads all of its parameters with one
+// GetParametersByPath call. An environment variable named after the
+// parameter overrides it, see OverrideName.
+type Resolver struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedValue
+
+	// loaded records when the parameters of an environment were bulk loaded
+	loaded map[string]time.Time
+}
+
+// NewResolver returns a Resolver caching values for ttl
+func NewResolver(ttl time.Duration) *Resolver {
+	return &Resolver{
+		ttl:    ttl,
+		cache:  make(map[string]cachedValue),
+		loaded: make(map[string]time.Time),
+	}
+}
+
+var defaultResolver = NewResolver(defaultCacheTTL)
+
+// SetTTL changes how long values resolved from now on are cached
+func (r *Resolver) SetTTL(ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ttl = ttl
+}
+
+// TableNameParameter returns the parameter holding the DynamoDB table
+// name for the given environment and table type
+func TableNameParameter(environment string, tableType string) string {
+	return fmt.Sprintf("%s/%s/dynamodb/%s-table-name", ParameterPrefix, environment, tableType)
+}
+
+// PolicyParameter returns the parameter holding the provision policy of
+// an environment
+func PolicyParameter(environment string) string {
+	return fmt.Sprintf("%s/%s/provision-policy", ParameterPrefix, environment)
+}
+
+// IsNotFound reports whether err is caused by a parameter that does not
+// exist
+func IsNotFound(err error) bool {
+	var notFound *types.ParameterNotFound
+	return errors.As(err, &notFound)
+}
+
+// OverrideName returns the environment variable that overrides a
+// parameter: the name upper-cased with every other character replaced
+// by an underscore, so /project-r3/dev/dynamodb/events-table-name is
+// overridden by PROJECT_R3_DEV_DYNAMODB_EVENTS_TABLE_NAME.
+func OverrideName(parameter string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, parameter), "_")
+}
+
+// TableName returns the DynamoDB table name for the given environment
+// and table type using the process-wide resolver
+func TableName(ctx context.Context, environment string, tableType string) (string, error) {
+	tableName, err := defaultResolver.Get(ctx, environment, TableNameParameter(environment, tableType))
+	if err != nil {
+		logging.Error(ctx, "Failed to get DynamoDB table names", err, logging.Fields{
+			logging.Environment: environment,
+			"table_type":        tableType,
+		})
+		return "", err
+	}
+
+	return tableName, nil
+}
+
+// Get returns the value of the named parameter of an environment
+func (r *Resolver) Get(ctx context.Context, environment string, name string) (string, error) {
+	if value, ok := os.LookupEnv(OverrideName(name)); ok {
+		return value, nil
+	}
+
+	if value, ok := r.cached(name); ok {
+		return value, nil
+	}
+
+	// Load every parameter of the environment at once, so the
+	// following lookups are served from the cache
+	if r.needsLoad(environment) {
+		if err := r.LoadPath(ctx, environment); err != nil {
+			logging.Warn(ctx, "Failed to bulk load parameters", logging.Fields{
+				logging.Environment: environment,
+				"error":             err.Error(),
+			})
+		}
+		if value, ok := r.cached(name); ok {
+			return value, nil
+		}
+	}
+
+	client, err := r.ssmClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	param, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(false),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve parameter value %s: %w", name, err)
+	}
+
+	value := aws.StringValue(param.Parameter.Value)
+	r.store(name, value)
+	return value, nil
+}
+
+// LoadPath loads every parameter under /project-r3/{env}/ into the cache
+func (r *Resolver) LoadPath(ctx context.Context, environment string) error {
+	client, err := r.ssmClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s/%s/", ParameterPrefix, environment)
+	paginator := ssm.NewGetParametersByPathPaginator(client, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(false),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve parameters under %s: %w", path, err)
+		}
+
+		for _, param := range page.Parameters {
+			r.store(aws.StringValue(param.Name), aws.StringValue(param.Value))
+		}
+	}
+
+	r.mu.Lock()
+	r.loaded[environment] = time.Now()
+	r.mu.Unlock()
+
+	return nil
+}
+
+// cached returns the cached value of name when it has not expired
+func (r *Resolver) cached(name string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.cache[name]
+	if !ok || time.Now().After(v.expiresAt) {
+		return "", false
+	}
+	return v.value, true
+}
+
+// store caches value under name
+func (r *Resolver) store(name string, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache[name] = cachedValue{value: value, expiresAt: time.Now().Add(r.ttl)}
+}
+
+// needsLoad reports whether the environment has not been bulk loaded
+// within the TTL
+func (r *Resolver) needsLoad(environment string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loadedAt, ok := r.loaded[environment]
+	return !ok || time.Since(loadedAt) > r.ttl
+}
+
+// ssmClient returns the SSM client for the home region, where the
+// parameters live
+func (r *Resolver) ssmClient(ctx context.Context) (*ssm.Client, error) {
+	return awsclient.Default().SSM(ctx, awsclient.HomeRegion)
+}
@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/auth"
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/30Piraten/aws-dynamicEventBuilder/redact"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// NewHistoryHandler returns the handler for querying the audit trail of
+// the deployment's environment. It takes provision_id and limit, and
+// optionally the environment, as query string parameters. Admins may read
+// the whole trail; any other caller only the history of an environment
+// instance they provisioned, so provision_id is required for them.
+func NewHistoryHandler(cfg *appconfig.Config) func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	return func(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+		return handleHistory(ctx, cfg, event)
+	}
+}
+
+func handleHistory(ctx context.Context, cfg *appconfig.Config, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	ctx = logging.WithLambdaRequest(ctx)
+	ctx = logging.WithField(ctx, logging.APIRequestID, event.RequestContext.RequestID)
+
+	caller, ok := auth.FromRequest(event)
+	if !ok {
+		return jsonResponse(401, map[string]any{"success": false, "message": "authentication required"}), nil
+	}
+	ctx = logging.WithField(ctx, "caller", caller.ID)
+	ctx = logging.WithField(ctx, "caller_name", caller.Name)
+
+	// Every event of this deployment is recorded under its environment
+	params := event.QueryStringParameters
+	environment := cfg.Environment
+	if v := params["environment"]; v != "" && v != environment {
+		return jsonResponse(400, map[string]any{"success": false, "message": fmt.Sprintf("this deployment serves environment %q", environment)}), nil
+	}
+
+	query := Query{ProvisionID: params["provision_id"]}
+	limit := 0
+	if v := params["limit"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return jsonResponse(400, map[string]any{"success": false, "message": "limit must be a positive number"}), nil
+		}
+		limit = n
+	}
+
+	admin := caller.InGroup(cfg.AdminGroups)
+	if !admin && query.ProvisionID == "" {
+		return jsonResponse(403, map[string]any{"success": false, "message": "provision_id is required unless you are an admin"}), nil
+	}
+
+	// Ownership is read from the provision event, so a caller's history
+	// is fetched whole before the limit applies
+	if admin {
+		query.Limit = limit
+	}
+
+	history, err := History(ctx, cfg.EventsTable, environment, query)
+	if err != nil {
+		logging.Error(ctx, "Failed to query audit history", err, logging.Fields{logging.Environment: environment})
+		return jsonResponse(500, map[string]any{"success": false, "message": "failed to query audit history"}), redact.Default().Error(err)
+	}
+
+	if !admin {
+		if !provisionedBy(history, caller.ID) {
+			// Not found rather than forbidden, so foreign IDs are not confirmed
+			logging.Warn(ctx, "Audit history request denied", logging.Fields{logging.ProvisionID: query.ProvisionID})
+			return jsonResponse(404, map[string]any{"success": false, "message": "environment not found"}), nil
+		}
+		if limit > 0 && len(history) > limit {
+			history = history[:limit]
+		}
+	}
+
+	return jsonResponse(200, map[string]any{"success": true, "events": history}), nil
+}
+
+// provisionedBy reports whether the history holds the provisioning of
+// the environment instance by caller
+func provisionedBy(history []Event, caller string) bool {
+	for _, e := range history {
+		if e.Action == ActionProvision && e.Actor == caller {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonResponse returns an API Gateway response with body encoded as JSON
+func jsonResponse(statusCode int, body any) events.APIGatewayV2HTTPResponse {
+	encoded, _ := json.Marshal(body)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Body:       string(encoded),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/google/uuid"
+)
+
+// Action is a lifecycle action recorded in the audit trail
+type Action string
+
+const (
+	ActionProvision        Action = "provision"
+	ActionExtend           Action = "extend"
+	ActionPin              Action = "pin"
+	ActionTeardown         Action = "teardown"
+	ActionExpiryCleanup    Action = "expiry-cleanup"
+	ActionDriftRemediation Action = "drift-remediation"
+	ActionSpotInterruption Action = "spot-interruption"
+)
+
+// Actors for actions the service takes on its own
+const (
+	ActorCleanup = "system:cleanup"
+	ActorDrift   = "system:drift"
+	ActorSpot    = "system:spot"
+)
+
+// Event is an append-only record of a lifecycle action. Events are keyed
+// by the environment of the deployment that recorded them, so the trail
+// of a deployment is a single partition, and sorted by EventID, which
+// starts with the timestamp.
+type Event struct {
+	Environment string            `json:"environment" dynamodbav:"environment"`
+	EventID     string            `json:"event_id" dynamodbav:"event_id"`
+	Timestamp   time.Time         `json:"timestamp" dynamodbav:"timestamp"`
+	Action      Action            `json:"action" dynamodbav:"action"`
+	Actor       string            `json:"actor" dynamodbav:"actor"`
+	ProvisionID string            `json:"provision_id,omitempty" dynamodbav:"provision_id,omitempty"`
+	InstanceID  string            `json:"instance_id,omitempty" dynamodbav:"instance_id,omitempty"`
+	Before      map[string]string `json:"before,omitempty" dynamodbav:"before,omitempty"`
+	After       map[string]string `json:"after,omitempty" dynamodbav:"after,omitempty"`
+	Reason      string            `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+}
+
+// Query narrows down the events returned by History
+type Query struct {
+	// ProvisionID limits the history to a single environment instance
+	ProvisionID string
+
+	// Limit is the maximum number of events returned, newest first.
+	// Zero returns every event.
+	Limit int
+}
+
+// Record appends the event to the audit trail in the given events table.
+// The timestamp and event ID are filled in when empty. An existing event
+// is never overwritten.
+func Record(ctx context.Context, tableName string, event Event) error {
+	if event.Environment == "" {
+		return fmt.Errorf("audit event has no environment")
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	if event.EventID == "" {
+		event.EventID = fmt.Sprintf("%s#%s", event.Timestamp.Format(time.RFC3339Nano), uuid.New().String())
+	}
+
+	client, err := dynamoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	item, err := attributevalue.MarshalMap(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(event_id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+
+	return nil
+}
+
+// ProvisionIndex is the events table index keyed by provision_id and
+// sorted by event_id
+const ProvisionIndex = "ProvisionIndex"
+
+// History returns the audit events of an environment, newest first
+func History(ctx context.Context, tableName string, environment string, query Query) ([]Event, error) {
+	client, err := dynamoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("#environment = :environment"),
+		ExpressionAttributeNames: map[string]string{
+			"#environment": "environment",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":environment": &types.AttributeValueMemberS{Value: environment},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+
+	// The events of one provisioning are read from the ProvisionIndex
+	// rather than filtered out of the whole partition
+	if query.ProvisionID != "" {
+		input.IndexName = aws.String(ProvisionIndex)
+		input.KeyConditionExpression = aws.String("#provision_id = :provision_id")
+		input.FilterExpression = aws.String("#environment = :environment")
+		input.ExpressionAttributeNames["#provision_id"] = "provision_id"
+		input.ExpressionAttributeValues[":provision_id"] = &types.AttributeValueMemberS{Value: query.ProvisionID}
+	}
+
+	var events []Event
+	paginator := dynamodb.NewQueryPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query audit events: %w", err)
+		}
+
+		var pageEvents []Event
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageEvents); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal audit events: %w", err)
+		}
+		events = append(events, pageEvents...)
+
+		if query.Limit > 0 && len(events) >= query.Limit {
+			return events[:query.Limit], nil
+		}
+	}
+
+	return events, nil
+}
+
+// dynamoClient returns the DynamoDB client for the home region, where
+// the events table lives
+func dynamoClient(ctx context.Context) (*dynamodb.Client, error) {
+	return awsclient.Default().DynamoDB(ctx, awsclient.HomeRegion)
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Sources a caller identity is taken from
+const (
+	SourceJWT        = "jwt"
+	SourceAuthorizer = "authorizer"
+	SourceIAM        = "iam"
+)
+
+// Caller is the authenticated identity behind an API request
+type Caller struct {
+	// ID identifies the caller: the JWT's subject qualified by its
+	// issuer, the authorizer's principal ID or the IAM principal ARN. It
+	// never changes for a caller, so ownership is checked against it.
+	ID     string   `json:"id"`
+	Groups []string `json:"groups,omitempty"`
+	Source string   `json:"source"`
+
+	// Name is for display only: the JWT's username or email, which a user
+	// can change or another user can later take. It is the ID otherwise.
+	Name string `json:"name,omitempty"`
+}
+
+// InGroup reports whether the caller belongs to any of the groups
+func (c Caller) InGroup(groups []string) bool {
+	for _, want := range groups {
+		for _, have := range c.Groups {
+			if want == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FromRequest returns the identity the HTTP API authenticated the request
+// with, from the payload format 2.0 authorizer context. JWT claims, e.g.
+// of a Cognito user pool, are preferred over a Lambda authorizer's
+// context, which is preferred over the IAM principal of a SigV4 signed
+// request. A JWT without a subject does not identify the caller. It returns false for unauthenticated requests.
+func FromRequest(event events.APIGatewayV2HTTPRequest) (Caller, bool) {
+	authorizer := event.RequestContext.Authorizer
+	if authorizer == nil {
+		return Caller{}, false
+	}
+
+	// JWT authorizer
+	if jwt := authorizer.JWT; jwt != nil {
+		claims := make(map[string]any, len(jwt.Claims))
+		for k, v := range jwt.Claims {
+			claims[k] = v
+		}
+		if sub := firstString(claims, "sub"); sub != "" {
+			id := sub
+			if iss := firstString(claims, "iss"); iss != "" {
+				id = iss + "|" + sub
+			}
+			name := firstString(claims, "cognito:username", "username", "email")
+			if name == "" {
+				name = id
+			}
+			return Caller{ID: id, Groups: splitGroups(claims["cognito:groups"]), Source: SourceJWT, Name: name}, true
+		}
+	}
+
+	// Lambda authorizer context
+	if id := firstString(authorizer.Lambda, "principalId", "principal_id"); id != "" {
+		return Caller{ID: id, Groups: splitGroups(authorizer.Lambda["groups"]), Source: SourceAuthorizer, Name: id}, true
+	}
+
+	// IAM authorization
+	if iam := authorizer.IAM; iam != nil && iam.UserARN != "" {
+		return Caller{ID: iam.UserARN, Source: SourceIAM, Name: iam.UserARN}, true
+	}
+
+	return Caller{}, false
+}
+
+// firstString returns the first non-empty string value of the keys
+func firstString(values map[string]any, keys ...string) string {
+	for _, key := range keys {
+		if s, ok := values[key].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// splitGroups parses a group claim. API Gateway passes Cognito groups as
+// a string such as "[admins developers]" or "admins,developers", while a
+// Lambda authorizer may pass a list.
+func splitGroups(value any) []string {
+	var raw []string
+	switch v := value.(type) {
+	case string:
+		raw = strings.FieldsFunc(strings.Trim(v, "[]"), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	case []any:
+		for _, item := range v {
+			raw = append(raw, fmt.Sprint(item))
+		}
+	case []string:
+		raw = v
+	}
+
+	var groups []string
+	for _, g := range raw {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
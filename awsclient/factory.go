@@ -0,0 +1,196 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Endpoints are custom endpoint URLs, e.g. http://localhost:4566, used
+// to run against local stand-ins of the AWS services. Empty fields use
+// the regular AWS endpoints. Default applies to every service without
+// its own override.
+type Endpoints struct {
+	Default    string `json:"default"`
+	EC2        string `json:"ec2"`
+	DynamoDB   string `json:"dynamodb"`
+	SSM        string `json:"ssm"`
+	CloudWatch string `json:"cloudwatch"`
+}
+
+// resolve returns the service override, falling back to Default
+func (e Endpoints) resolve(override string) string {
+	if override != "" {
+		return override
+	}
+	return e.Default
+}
+
+// HomeRegion is the region of the default config chain, AWS_REGION in
+// Lambda. The service's own tables, parameters and metrics live there,
+// whatever region an environment is provisioned in.
+const HomeRegion = ""
+
+// Factory builds AWS clients and caches them per region, so warm
+// invocations reuse the loaded config and its connections.
+type Factory struct {
+	endpoints Endpoints
+
+	mu         sync.Mutex
+	configs    map[string]aws.Config
+	ec2        map[string]*ec2.Client
+	dynamodb   map[string]*dynamodb.Client
+	ssm        map[string]*ssm.Client
+	cloudwatch map[string]*cloudwatch.Client
+}
+
+// New returns a Factory using the given endpoint overrides
+func New(endpoints Endpoints) *Factory {
+	return &Factory{
+		endpoints:  endpoints,
+		configs:    make(map[string]aws.Config),
+		ec2:        make(map[string]*ec2.Client),
+		dynamodb:   make(map[string]*dynamodb.Client),
+		ssm:        make(map[string]*ssm.Client),
+		cloudwatch: make(map[string]*cloudwatch.Client),
+	}
+}
+
+var (
+	defaultMu      sync.Mutex
+	defaultFactory = New(Endpoints{})
+)
+
+// Configure replaces the process-wide factory with one using the given
+// endpoint overrides. It is called once at cold start.
+func Configure(endpoints Endpoints) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultFactory = New(endpoints)
+}
+
+// Default returns the process-wide factory
+func Default() *Factory {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	return defaultFactory
+}
+
+// regionName matches AWS region names such as eu-west-1 or
+// us-gov-west-1
+var regionName = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// ValidRegion reports whether region is shaped like an AWS region name
+func ValidRegion(region string) bool {
+	return regionName.MatchString(region)
+}
+
+// loadConfig loads the AWS config for region. It may take a while, e.g.
+// to fetch credentials, so it is called without holding f.mu.
+func loadConfig(ctx context.Context, region string) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != HomeRegion {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config for region %q: %w", region, err)
+	}
+	return cfg, nil
+}
+
+// cachedClient returns the client for region from cache, building it
+// from the region's config on first use. Regions come from requests and
+// records, so only well-formed names become cache keys. Two callers may
+// build a client for the same region at once; the first one stored wins.
+func cachedClient[T any](ctx context.Context, f *Factory, cache map[string]*T, region string, build func(aws.Config) *T) (*T, error) {
+	if region != HomeRegion && !ValidRegion(region) {
+		return nil, fmt.Errorf("invalid region %q", region)
+	}
+
+	f.mu.Lock()
+	client, ok := cache[region]
+	cfg, loaded := f.configs[region]
+	f.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	if !loaded {
+		var err error
+		if cfg, err = loadConfig(ctx, region); err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if client, ok := cache[region]; ok {
+		return client, nil
+	}
+	if existing, ok := f.configs[region]; ok {
+		cfg = existing
+	} else {
+		f.configs[region] = cfg
+	}
+
+	client = build(cfg)
+	cache[region] = client
+	return client, nil
+}
+
+// EC2 returns the EC2 client for region
+func (f *Factory) EC2(ctx context.Context, region string) (*ec2.Client, error) {
+	return cachedClient(ctx, f, f.ec2, region, func(cfg aws.Config) *ec2.Client {
+		return ec2.NewFromConfig(cfg, func(o *ec2.Options) {
+			if url := f.endpoints.resolve(f.endpoints.EC2); url != "" {
+				o.BaseEndpoint = aws.String(url)
+			}
+		})
+	})
+}
+
+// DynamoDB returns the DynamoDB client for region
+func (f *Factory) DynamoDB(ctx context.Context, region string) (*dynamodb.Client, error) {
+	return cachedClient(ctx, f, f.dynamodb, region, func(cfg aws.Config) *dynamodb.Client {
+		return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			if url := f.endpoints.resolve(f.endpoints.DynamoDB); url != "" {
+				o.BaseEndpoint = aws.String(url)
+			}
+		})
+	})
+}
+
+// SSM returns the SSM client for region
+func (f *Factory) SSM(ctx context.Context, region string) (*ssm.Client, error) {
+	return cachedClient(ctx, f, f.ssm, region, func(cfg aws.Config) *ssm.Client {
+		return ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+			if url := f.endpoints.resolve(f.endpoints.SSM); url != "" {
+				o.BaseEndpoint = aws.String(url)
+			}
+		})
+	})
+}
+
+// CloudWatch returns the CloudWatch client for region
+func (f *Factory) CloudWatch(ctx context.Context, region string) (*cloudwatch.Client, error) {
+	return cachedClient(ctx, f, f.cloudwatch, region, func(cfg aws.Config) *cloudwatch.Client {
+		return cloudwatch.NewFromConfig(cfg, func(o *cloudwatch.Options) {
+			if url := f.endpoints.resolve(f.endpoints.CloudWatch); url != "" {
+				o.BaseEndpoint = aws.String(url)
+			}
+		})
+	})
+}
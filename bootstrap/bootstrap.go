@@ -0,0 +1,202 @@
+package bootstrap
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//go:embed templates/*.sh
+var embeddedTemplates embed.FS
+
+// MaxUserDataSize is the most user data EC2 accepts, before it is base64
+// encoded
+const MaxUserDataSize = 16 * 1024
+
+// ErrUnknownTemplate is returned for a template name that is not loaded
+var ErrUnknownTemplate = errors.New("unknown bootstrap template")
+
+// ErrTooLarge is returned for user data over MaxUserDataSize
+var ErrTooLarge = errors.New("user data is too large")
+
+// paramName restricts parameter names to what can be used as a shell
+// variable name
+var paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Vars are the values a bootstrap template is rendered with. Params are
+// supplied by the caller and must be quoted in the template.
+type Vars struct {
+	Environment string
+	ProvisionID string
+	Region      string
+	Owner       string
+	ExpiresAt   time.Time
+	Params      map[string]string
+}
+
+// Set is a set of named bootstrap templates. A template's name is its
+// file name without the .sh extension.
+type Set struct {
+	templates map[string]*template.Template
+}
+
+// funcs are available in every template. quote makes a value safe to use
+// as a single shell word.
+var funcs = template.FuncMap{
+	"quote": quote,
+	"rfc3339": func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	},
+	"envName": strings.ToUpper,
+	"required": func(name string, params map[string]string) (string, error) {
+		v, ok := params[name]
+		if !ok || v == "" {
+			return "", fmt.Errorf("parameter %q is required", name)
+		}
+		return v, nil
+	},
+}
+
+// quote single-quotes s for the shell
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Parse parses every *.sh file of fsys as a template
+func Parse(fsys fs.FS) (*Set, error) {
+	files, err := fs.Glob(fsys, "*.sh")
+	if err != nil {
+		return nil, err
+	}
+
+	set := &Set{templates: make(map[string]*template.Template, len(files))}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bootstrap template %s: %w", file, err)
+		}
+
+		name := strings.TrimSuffix(file, filepath.Ext(file))
+		tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bootstrap template %s: %w", file, err)
+		}
+		set.templates[name] = tmpl
+	}
+
+	return set, nil
+}
+
+// Names returns the names of the templates in the set
+func (s *Set) Names() []string {
+	names := make([]string, 0, len(s.templates))
+	for name := range s.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render renders the named template. The result is checked against
+// MaxUserDataSize. Errors never include the rendered script.
+func (s *Set) Render(name string, vars Vars) (string, error) {
+	tmpl, ok := s.templates[name]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	}
+
+	for key := range vars.Params {
+		if !paramName.MatchString(key) {
+			return "", fmt.Errorf("invalid parameter name %q", key)
+		}
+	}
+	if vars.Params == nil {
+		vars.Params = map[string]string{}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("failed to render bootstrap template %q: %w", name, err)
+	}
+
+	if err := CheckSize(buf.String()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// CheckSize returns ErrTooLarge when script exceeds MaxUserDataSize
+func CheckSize(script string) error {
+	if len(script) > MaxUserDataSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, len(script), MaxUserDataSize)
+	}
+	return nil
+}
+
+// Encode returns script base64 encoded, as RunInstances expects it
+func Encode(script string) string {
+	return base64.StdEncoding.EncodeToString([]byte(script))
+}
+
+var (
+	defaultMu  sync.RWMutex
+	defaultSet *Set
+)
+
+func init() {
+	sub, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		panic(err)
+	}
+	set, err := Parse(sub)
+	if err != nil {
+		panic(err)
+	}
+	defaultSet = set
+}
+
+// Configure adds the templates in dir to the process-wide set, replacing
+// embedded templates of the same name. An empty dir keeps the embedded
+// templates only. It is called once at cold start.
+func Configure(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	loaded, err := Parse(os.DirFS(dir))
+	if err != nil {
+		return fmt.Errorf("failed to load bootstrap templates from %s: %w", dir, err)
+	}
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	set := &Set{templates: make(map[string]*template.Template)}
+	for name, tmpl := range defaultSet.templates {
+		set.templates[name] = tmpl
+	}
+	for name, tmpl := range loaded.templates {
+		set.templates[name] = tmpl
+	}
+	defaultSet = set
+	return nil
+}
+
+// Default returns the process-wide template set
+func Default() *Set {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	return defaultSet
+}
@@ -0,0 +1,103 @@
+package bootstrap
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// testVars are rendered into the embedded templates
+var testVars = Vars{
+	Environment: "dev",
+	ProvisionID: "p-1",
+	Region:      "eu-west-1",
+	Owner:       "alice",
+	ExpiresAt:   time.Date(2026, 10, 19, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60)),
+}
+
+func TestRenderBase(t *testing.T) {
+	vars := testVars
+	vars.Params = map[string]string{"app_name": "web"}
+
+	script, err := Default().Render("base", vars)
+	if err != nil {
+		t.Fatalf("Render() = %v", err)
+	}
+
+	for _, line := range []string{
+		"ENVIRONMENT='dev'",
+		"PROVISION_ID='p-1'",
+		"EXPIRES_AT='2026-10-19T10:00:00Z'",
+		"APP_NAME='web'",
+	} {
+		if !strings.Contains(script, line) {
+			t.Errorf("rendered script lacks %q:\n%s", line, script)
+		}
+	}
+}
+
+// A parameter cannot break out of its quotes
+func TestRenderQuotesParams(t *testing.T) {
+	vars := testVars
+	vars.Params = map[string]string{"x": "'; rm -rf / #"}
+
+	script, err := Default().Render("base", vars)
+	if err != nil {
+		t.Fatalf("Render() = %v", err)
+	}
+	if want := `X=''\''; rm -rf / #'`; !strings.Contains(script, want) {
+		t.Errorf("rendered script lacks %q:\n%s", want, script)
+	}
+}
+
+func TestRenderDocker(t *testing.T) {
+	vars := testVars
+	vars.Params = map[string]string{"image": "nginx:latest", "port": "80"}
+
+	script, err := Default().Render("docker", vars)
+	if err != nil {
+		t.Fatalf("Render() = %v", err)
+	}
+	if !strings.Contains(script, "-p '80:80'") || !strings.Contains(script, "'nginx:latest'") {
+		t.Errorf("rendered script lacks the image or port:\n%s", script)
+	}
+
+	if _, err := Default().Render("docker", testVars); err == nil || !strings.Contains(err.Error(), `parameter "image" is required`) {
+		t.Errorf("Render() without image = %v, want the required parameter error", err)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	set, err := Parse(fstest.MapFS{
+		"echo.sh":   {Data: []byte(`{{ range $_, $v := .Params }}{{ $v }}{{ end }}`)},
+		"strict.sh": {Data: []byte(`{{ .Params.missing }}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := set.Render("nope", testVars); !errors.Is(err, ErrUnknownTemplate) {
+		t.Errorf("unknown template: Render() = %v, want ErrUnknownTemplate", err)
+	}
+
+	if _, err := set.Render("strict", testVars); err == nil {
+		t.Error("missing key: Render() = nil, want an error")
+	}
+
+	vars := testVars
+	vars.Params = map[string]string{"bad-name": "x"}
+	if _, err := set.Render("echo", vars); err == nil {
+		t.Error("invalid parameter name: Render() = nil, want an error")
+	}
+
+	vars.Params = map[string]string{"a": strings.Repeat("x", MaxUserDataSize)}
+	if _, err := set.Render("echo", vars); err != nil {
+		t.Errorf("script at the limit: Render() = %v, want nil", err)
+	}
+	vars.Params = map[string]string{"a": strings.Repeat("x", MaxUserDataSize+1)}
+	if _, err := set.Render("echo", vars); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("script over the limit: Render() = %v, want ErrTooLarge", err)
+	}
+}
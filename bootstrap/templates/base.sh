@@ -0,0 +1,16 @@
+#!/bin/bash
+# Describes the environment to anything running on the instance
+set -euo pipefail
+
+mkdir -p /etc/provisioned
+cat > /etc/provisioned/environment <<'VARS'
+ENVIRONMENT={{ quote .Environment }}
+PROVISION_ID={{ quote .ProvisionID }}
+REGION={{ quote .Region }}
+OWNER={{ quote .Owner }}
+EXPIRES_AT={{ quote (rfc3339 .ExpiresAt) }}
+{{- range $key, $value := .Params }}
+{{ envName $key }}={{ quote $value }}
+{{- end }}
+VARS
+chmod 0640 /etc/provisioned/environment
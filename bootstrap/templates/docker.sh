@@ -0,0 +1,20 @@
+#!/bin/bash
+# Installs Docker and runs the image given by the "image" parameter,
+# publishing the "port" parameter when set
+set -euo pipefail
+
+if command -v dnf >/dev/null; then
+  dnf install -y docker
+else
+  apt-get update && apt-get install -y docker.io
+fi
+systemctl enable --now docker
+
+docker run -d --restart unless-stopped \
+  -e ENVIRONMENT={{ quote .Environment }} \
+  -e PROVISION_ID={{ quote .ProvisionID }} \
+  -e EXPIRES_AT={{ quote (rfc3339 .ExpiresAt) }} \
+{{- with index .Params "port" }}
+  -p {{ quote (printf "%s:%s" . .) }} \
+{{- end }}
+  {{ quote (required "image" .Params) }}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/audit"
+)
+
+// history prints the audit trail of an environment, newest first
+func history(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	environment := fs.String("env", "", "environment to show the history of (required)")
+	provisionID := fs.String("provision-id", "", "only show events of this provision ID")
+	limit := fs.Int("limit", 50, "maximum number of events, 0 for all")
+	asJSON := fs.Bool("json", false, "print the events as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *environment == "" {
+		return fmt.Errorf("-env is required")
+	}
+
+	tableName, err := appconfig.TableName(ctx, *environment, appconfig.Defaults().EventsTableType)
+	if err != nil {
+		return err
+	}
+
+	events, err := audit.History(ctx, tableName, *environment, audit.Query{
+		ProvisionID: *provisionID,
+		Limit:       *limit,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(events)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tACTOR\tPROVISION ID\tINSTANCE ID\tSTATUS\tREASON")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s -> %s\t%s\n",
+			e.Timestamp.Format(time.RFC3339), e.Action, e.Actor, e.ProvisionID, e.InstanceID,
+			e.Before["status"], e.After["status"], e.Reason)
+	}
+	return w.Flush()
+}
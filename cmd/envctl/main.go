@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+)
+
+// envctl is the command line client for the environment service.
+//
+//	envctl history -env dev [-provision-id ID] [-limit N]
+//	envctl report -env dev [-all]
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	// Talk to a local stand-in when ENDPOINT_URL is set
+	awsclient.Configure(awsclient.Endpoints{Default: os.Getenv("ENDPOINT_URL")})
+
+	var err error
+	switch os.Args[1] {
+	case "history":
+		err = history(ctx, os.Args[2:])
+	case "report":
+		err = report(ctx, os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "envctl:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: envctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  history   show the audit trail of an environment")
+	fmt.Fprintln(os.Stderr, "  report    show the estimated cost per owner and environment")
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
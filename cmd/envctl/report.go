@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/30Piraten/aws-dynamicEventBuilder/inventory"
+)
+
+// report prints the estimated cost of the tracked environments summed
+// per owner and environment
+func report(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	environment := fs.String("env", "", "environment whose tracking table is reported (required)")
+	all := fs.Bool("all", false, "include terminated instances")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *environment == "" {
+		return fmt.Errorf("-env is required")
+	}
+
+	tableName, err := appconfig.TableName(ctx, *environment, appconfig.Defaults().TrackingTableType)
+	if err != nil {
+		return err
+	}
+
+	client, err := awsclient.Default().DynamoDB(ctx, awsclient.HomeRegion)
+	if err != nil {
+		return err
+	}
+
+	lines, err := inventory.CostReport(ctx, client, tableName, *all)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(lines)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OWNER\tENVIRONMENT\tINSTANCES\tUNPRICED\tOPEN-ENDED\tESTIMATED COST")
+	for _, l := range lines {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%.2f %s\n",
+			l.Owner, l.Environment, l.Instances, l.Unpriced, l.OpenEnded, l.EstimatedCost, l.Currency)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,129 @@
+package cost
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// prices.json holds the on-demand Linux hourly prices. Update it and
+// rebuild, or point PRICE_TABLE_FILE at a file of the same shape.
+//
+//go:embed prices.json
+var embeddedPrices []byte
+
+// ErrUnknownPrice is returned when the table has no price for a region
+// and instance type
+var ErrUnknownPrice = errors.New("no price for instance type")
+
+// PriceTable holds hourly instance prices keyed by region and instance type
+type PriceTable struct {
+	Currency string                        `json:"currency"`
+	Updated  string                        `json:"updated"`
+	Regions  map[string]map[string]float64 `json:"regions"`
+}
+
+// Estimate is the estimated cost of running Count instances for Hours
+type Estimate struct {
+	Currency   string  `json:"currency"`
+	HourlyRate float64 `json:"hourly_rate"`
+	Count      int     `json:"count"`
+	Hours      float64 `json:"hours"`
+	Total      float64 `json:"total"`
+}
+
+// Parse parses a price table in the format of prices.json
+func Parse(data []byte) (*PriceTable, error) {
+	var table PriceTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("failed to parse price table: %w", err)
+	}
+	if table.Currency == "" || len(table.Regions) == 0 {
+		return nil, fmt.Errorf("price table has no currency or regions")
+	}
+
+	for region, prices := range table.Regions {
+		for instanceType, price := range prices {
+			if price < 0 {
+				return nil, fmt.Errorf("negative price for %s in %s", instanceType, region)
+			}
+		}
+	}
+
+	return &table, nil
+}
+
+// Load reads a price table from a file
+func Load(path string) (*PriceTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price table %s: %w", path, err)
+	}
+	return Parse(data)
+}
+
+// Estimate returns the cost of running count instances of instanceType
+// in region for the given number of hours
+func (t *PriceTable) Estimate(region string, instanceType string, count int, hours float64) (Estimate, error) {
+	rate, ok := t.Regions[region][instanceType]
+	if !ok {
+		return Estimate{}, fmt.Errorf("%w %s in region %q", ErrUnknownPrice, instanceType, region)
+	}
+
+	return Estimate{
+		Currency:   t.Currency,
+		HourlyRate: rate,
+		Count:      count,
+		Hours:      hours,
+		Total:      Round(rate * float64(count) * hours),
+	}, nil
+}
+
+// Round rounds an amount to whole cents
+func Round(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+var (
+	defaultMu    sync.RWMutex
+	defaultTable *PriceTable
+)
+
+func init() {
+	table, err := Parse(embeddedPrices)
+	if err != nil {
+		panic(err)
+	}
+	defaultTable = table
+}
+
+// Configure replaces the process-wide price table with the one in path.
+// An empty path keeps the embedded table. It is called once at cold start.
+func Configure(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	table, err := Load(path)
+	if err != nil {
+		return err
+	}
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultTable = table
+	return nil
+}
+
+// Default returns the process-wide price table
+func Default() *PriceTable {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	return defaultTable
+}
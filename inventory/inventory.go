@@ -0,0 +1,163 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/30Piraten/aws-dynamicEventBuilder/metrics"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// NewInventoryHandler returns the handler for a standalone, scheduled
+// inventory run. It publishes the fleet gauges and returns.
+func NewInventoryHandler(cfg *appconfig.Config) func(context.Context, events.CloudWatchEvent) error {
+	return func(ctx context.Context, event events.CloudWatchEvent) error {
+		return handleInventory(ctx, cfg)
+	}
+}
+
+func handleInventory(ctx context.Context, cfg *appconfig.Config) error {
+	ctx = logging.WithLambdaRequest(ctx)
+
+	client, err := awsclient.Default().DynamoDB(ctx, awsclient.HomeRegion)
+	if err != nil {
+		return err
+	}
+
+	recorder := metrics.NewRecorder()
+	if err := Publish(ctx, client, cfg.TrackingTable, cfg.Environment, recorder); err != nil {
+		return err
+	}
+
+	return recorder.Flush(ctx)
+}
+
+// zeroWindow is how long after its last instance went away a group keeps
+// getting its gauges at zero
+const zeroWindow = 24 * time.Hour
+
+// group is the set of dimensions the inventory is counted by
+type group struct {
+	Environment  string
+	Region       string
+	InstanceType string
+	Owner        string
+}
+
+// Publish counts the ACTIVE records in the tracking table by environment,
+// region, instance type and owner, and buffers an ActiveInstances and an
+// InstanceHours gauge for each group on recorder. InstanceHours is the
+// time since creation summed over the group.
+//
+// A group whose last instance went away still gets its gauges, at zero,
+// for zeroWindow after a record of it was stopped or terminated, so the
+// gauge does not keep its last value. Older records are left out, or
+// every group ever provisioned would be published. An
+// ActiveInstancesTotal gauge by environment alone is published as well,
+// for environment and the environments of those groups.
+func Publish(ctx context.Context, client *dynamodb.Client, tableName string, environment string, recorder *metrics.Recorder) error {
+	entries, err := entriesWithStatus(ctx, client, tableName, provisionenv.StatusActive, provisionenv.StatusStopped, provisionenv.StatusTerminated)
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	cutoff := time.Now().Add(-zeroWindow)
+	active := 0
+	counts := make(map[group]int)
+	hours := make(map[group]float64)
+	totals := map[string]int{environment: 0}
+	for _, entry := range entries {
+		g := group{
+			Environment:  entry.Environment,
+			Region:       entry.Region,
+			InstanceType: entry.InstanceType,
+			Owner:        entry.Owner,
+		}
+		// Recently stopped and terminated records only make their group
+		// known
+		if entry.Status != provisionenv.StatusActive {
+			if entry.StatusChangedAt.Before(cutoff) {
+				continue
+			}
+			if _, ok := counts[g]; !ok {
+				counts[g] = 0
+			}
+			if _, ok := totals[g.Environment]; !ok {
+				totals[g.Environment] = 0
+			}
+			continue
+		}
+		active++
+		counts[g]++
+		hours[g] += time.Since(entry.CreatedAt).Hours()
+		totals[g.Environment]++
+	}
+
+	for env, total := range totals {
+		recorder.Gauge(metrics.ActiveInstancesTotal, float64(total), metrics.Dimensions{Environment: env})
+	}
+
+	for g, count := range counts {
+		dims := metrics.Dimensions{
+			Environment:  g.Environment,
+			Region:       g.Region,
+			InstanceType: g.InstanceType,
+			Owner:        g.Owner,
+		}
+		recorder.Gauge(metrics.ActiveInstances, float64(count), dims)
+		recorder.Gauge(metrics.InstanceHours, hours[g], dims)
+	}
+
+	logging.Info(ctx, "Published fleet inventory", logging.Fields{
+		"active_instances": active,
+		"groups":           len(counts),
+	})
+	return nil
+}
+
+// entriesWithStatus scans the tracking table for records in any of the
+// given statuses
+func entriesWithStatus(ctx context.Context, client *dynamodb.Client, tableName string, statuses ...string) ([]provisionenv.StateEntry, error) {
+	values := make(map[string]types.AttributeValue, len(statuses))
+	placeholders := make([]string, 0, len(statuses))
+	for i, status := range statuses {
+		placeholder := fmt.Sprintf(":status%d", i)
+		values[placeholder] = &types.AttributeValueMemberS{Value: status}
+		placeholders = append(placeholders, placeholder)
+	}
+
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:        aws.String(tableName),
+		FilterExpression: aws.String(fmt.Sprintf("#status IN (%s)", strings.Join(placeholders, ", "))),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: values,
+	})
+
+	var entries []provisionenv.StateEntry
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var pageEntries []provisionenv.StateEntry
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageEntries); err != nil {
+			return nil, err
+		}
+		entries = append(entries, pageEntries...)
+	}
+
+	return entries, nil
+}
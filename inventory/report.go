@@ -0,0 +1,80 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/cost"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// CostLine is the estimated cost of the instances one owner runs in
+// one environment
+type CostLine struct {
+	Owner         string  `json:"owner"`
+	Environment   string  `json:"environment"`
+	Instances     int     `json:"instances"`
+	Unpriced      int     `json:"unpriced,omitempty"`
+	OpenEnded     int     `json:"open_ended,omitempty"`
+	EstimatedCost float64 `json:"estimated_cost"`
+	Currency      string  `json:"currency,omitempty"`
+}
+
+// CostReport sums the estimated cost stored on the tracking table records
+// per owner and environment. Only live (active or stopped) instances are
+// included unless includeTerminated is set. Records provisioned without
+// an estimate are counted as unpriced, pinned ones, whose estimate ends
+// at an expiry they run past, as open-ended.
+func CostReport(ctx context.Context, client *dynamodb.Client, tableName string, includeTerminated bool) ([]CostLine, error) {
+	statuses := []string{provisionenv.StatusActive, provisionenv.StatusStopped}
+	if includeTerminated {
+		statuses = append(statuses, provisionenv.StatusTerminated)
+	}
+
+	entries, err := entriesWithStatus(ctx, client, tableName, statuses...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	type key struct {
+		Owner       string
+		Environment string
+		Currency    string
+	}
+
+	lines := make(map[key]*CostLine)
+	for _, entry := range entries {
+		k := key{Owner: entry.Owner, Environment: entry.Environment, Currency: entry.CostCurrency}
+		line, ok := lines[k]
+		if !ok {
+			line = &CostLine{Owner: k.Owner, Environment: k.Environment, Currency: k.Currency}
+			lines[k] = line
+		}
+
+		line.Instances++
+		if entry.CostCurrency == "" {
+			line.Unpriced++
+		}
+		if entry.CostOpenEnded {
+			line.OpenEnded++
+		}
+		line.EstimatedCost += entry.EstimatedCost
+	}
+
+	report := make([]CostLine, 0, len(lines))
+	for _, line := range lines {
+		line.EstimatedCost = cost.Round(line.EstimatedCost)
+		report = append(report, *line)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Owner != report[j].Owner {
+			return report[i].Owner < report[j].Owner
+		}
+		return report[i].Environment < report[j].Environment
+	})
+
+	return report, nil
+}
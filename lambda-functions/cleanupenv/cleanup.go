@@ -2,16 +2,20 @@ package cleanupenv
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/audit"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/30Piraten/aws-dynamicEventBuilder/inventory"
 	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
 	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
 	"github.com/30Piraten/aws-dynamicEventBuilder/metrics"
-	"github.com/30Piraten/aws-dynamicEventBuilder/ssm"
+	"github.com/30Piraten/aws-dynamicEventBuilder/quota"
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -19,93 +23,175 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 )
 
-// HandleCleanupRequest is the handler for the cleanup
+// NewCleanupHandler returns the handler for the cleanup
 // of expired EC2 instances
-func HandleCleanupRequest(ctx context.Context, event events.CloudWatchEvent, environment string, tableType string) error {
+func NewCleanupHandler(cfg *appconfig.Config) func(context.Context, events.CloudWatchEvent) error {
+	return func(ctx context.Context, event events.CloudWatchEvent) error {
+		return handleCleanup(ctx, cfg, event)
+	}
+}
 
-	// Initialise the AWS config
-	config, err := config.LoadDefaultConfig(ctx)
+func handleCleanup(ctx context.Context, cfg *appconfig.Config, event events.CloudWatchEvent) error {
 
+	ctx = logging.WithLambdaRequest(ctx)
+
+	// The tracking table lives in the home region
+	dynamodbClient, err := awsclient.Default().DynamoDB(ctx, awsclient.HomeRegion)
 	if err != nil {
 		return fmt.Errorf("failed to load SDK configuration, %v", err)
 	}
 
-	// Create clients
-	ec2Client := ec2.NewFromConfig(config)
-	dynamodbClient := dynamodb.NewFromConfig(config)
-
 	// Get the expired instances
-	expiredInstances, err := getExpiredInstances(ctx, dynamodbClient, environment, tableType)
+	expiredInstances, err := getExpiredInstances(ctx, dynamodbClient, cfg.TrackingTable)
 	if err != nil {
 		return fmt.Errorf("failed to get expired instances, %v", err)
 	}
 
+	recorder := metrics.NewRecorder()
+
+	// Publish an explicit zero so that quiet runs are visible
+	if len(expiredInstances) == 0 {
+		recorder.Count(metrics.InstancesTerminated, 0, metrics.Dimensions{
+			Environment: cfg.Environment,
+			Outcome:     metrics.OutcomeSuccess,
+		})
+	}
+
+	// Group the expired instances by the region they were provisioned in,
+	// so each is terminated through a client for that region
+	byRegion := make(map[string][]provisionenv.StateEntry)
+	for _, instance := range expiredInstances {
+		byRegion[instance.Region] = append(byRegion[instance.Region], instance)
+	}
+
 	// WaitGroup for synchronising goroutines
 	var wg sync.WaitGroup
 
 	// Terminate expired instances
-	for _, instance := range expiredInstances {
-
-		wg.Add(1)
-		go func(instance provisionenv.StateEntry) {
-			defer wg.Done()
-			if err := terminateInstance(ctx, ec2Client, instance); err != nil {
-				logging.LogError(fmt.Sprintf("Failed to terminate instance: %s", instance.InstanceID), err)
-				// continue
-			} else {
-				logging.LogInfo(fmt.Sprintf("Successfully terminated instance: %s", instance.InstanceID))
-			}
+	for region, regionInstances := range byRegion {
+		ec2Client, err := awsclient.Default().EC2(ctx, region)
+		if err != nil {
+			// The records stay expired and are retried on the next run
+			logging.Error(ctx, "Failed to create EC2 client", err, logging.Fields{logging.Region: region, "instances": len(regionInstances)})
+			continue
+		}
 
-			// Mark as terminated in DynamoDB
-			if err := MarkInstanceAsTerminated(ctx, dynamodbClient, instance.ID, environment, tableType); err != nil {
-				logging.LogInfo(fmt.Sprintf("Failed to update instance status %s: %v", instance.ID, err))
-			} else {
-				logging.LogInfo(fmt.Sprintf("Successfully updated instance status: %s", instance.ID))
-			}
-		}(instance)
+		for _, instance := range regionInstances {
+			wg.Add(1)
+			go func(instance provisionenv.StateEntry) {
+				defer wg.Done()
+				cleanupInstance(ctx, cfg, ec2Client, dynamodbClient, recorder, instance)
+			}(instance)
+		}
 	}
 
 	// Wait for all gorooutines to finish
 	wg.Wait()
 
+	// Refresh the fleet inventory gauges now that expired instances are gone
+	if err := inventory.Publish(ctx, dynamodbClient, cfg.TrackingTable, cfg.Environment, recorder); err != nil {
+		logging.Error(ctx, "Failed to publish inventory metrics", err)
+	}
+
 	// Publish metrics for terminated instances
-	metrics.PublishTerminationMetric(ctx)
+	recorder.Flush(ctx)
 
 	return nil
 }
 
-func getExpiredInstances(ctx context.Context, client *dynamodb.Client, environment string, tableType string) ([]provisionenv.StateEntry, error) {
+// cleanupInstance terminates an expired instance through ec2Client, which
+// targets the instance's region, marks its record as terminated and
+// records the cleanup in the audit trail
+func cleanupInstance(ctx context.Context, cfg *appconfig.Config, ec2Client *ec2.Client, dynamodbClient *dynamodb.Client, recorder *metrics.Recorder, instance provisionenv.StateEntry) {
+	ctx = logging.WithField(ctx, logging.ProvisionID, instance.ID)
+	fields := logging.Fields{
+		logging.InstanceID:  instance.InstanceID,
+		logging.Environment: instance.Environment,
+		logging.Region:      instance.Region,
+	}
 
-	currentTime := time.Now().Unix()
+	dims := metrics.Dimensions{
+		Environment: instance.Environment,
+		Region:      instance.Region,
+	}
 
-	tableName, err := ssm.TableName(environment, tableType)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get table name: %w", err)
+	if err := terminateInstance(ctx, ec2Client, instance); err != nil {
+		logging.Error(ctx, "Failed to terminate instance", err, fields)
+		recorder.Failure(metrics.TerminationFailures, err, dims)
+		dims.Outcome = metrics.OutcomeFailure
+		recorder.Count(metrics.InstancesTerminated, 1, dims)
+
+		// The instance may still be running, so its record stays live
+		// and holds the quota until the next run retries
+		return
 	}
+	logging.Info(ctx, "Successfully terminated instance", fields)
+	dims.Outcome = metrics.OutcomeSuccess
+	recorder.Duration(metrics.ExpiryToTermination, time.Since(instance.ExpiresAt), dims)
+	recorder.Count(metrics.InstancesTerminated, 1, dims)
 
-	input := &dynamodb.QueryInput{
-		TableName:              aws.String(tableName),
-		IndexName:              aws.String("TTLIndex"),
-		KeyConditionExpression: aws.String("TTL <= :now AND #status = :status"),
-		ExpressionAttributeNames: map[string]string{
-			"#status": "status",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":now": &types.AttributeValueMemberN{
-				Value: fmt.Sprintf("%d", currentTime),
-			},
-			":status": &types.AttributeValueMemberS{Value: "ACTIVE"},
-		},
+	// Mark as terminated in DynamoDB
+	if err := MarkInstanceAsTerminated(ctx, dynamodbClient, instance.ID, instance.Team, instance.VCPUs, cfg.TrackingTable); err != nil {
+		logging.Error(ctx, "Failed to update instance status", err, fields)
+	} else {
+		logging.Info(ctx, "Successfully updated instance status", fields)
 	}
 
-	result, err := client.Query(ctx, input)
-	if err != nil {
-		return nil, err
+	// Record the expiry cleanup in the audit trail
+	if err := audit.Record(ctx, cfg.EventsTable, audit.Event{
+		Environment: cfg.Environment,
+		Action:      audit.ActionExpiryCleanup,
+		Actor:       audit.ActorCleanup,
+		ProvisionID: instance.ID,
+		InstanceID:  instance.InstanceID,
+		Before:      map[string]string{"status": instance.Status},
+		After:       map[string]string{"status": provisionenv.StatusTerminated},
+		Reason:      fmt.Sprintf("expired at %s", instance.ExpiresAt.Format(time.RFC3339)),
+	}); err != nil {
+		logging.Error(ctx, "Failed to record audit event", err, fields)
 	}
+}
+
+// getExpiredInstances returns every tracked instance whose TTL has passed.
+// Stopped instances are included so that they are still terminated on expiry.
+func getExpiredInstances(ctx context.Context, client *dynamodb.Client, tableName string) ([]provisionenv.StateEntry, error) {
+
+	currentTime := time.Now().Unix()
 
 	var instances []provisionenv.StateEntry
-	err = attributevalue.UnmarshalListOfMaps(result.Items, &instances)
-	return instances, err
+	for _, status := range []string{provisionenv.StatusActive, provisionenv.StatusStopped} {
+		// TTL is a reserved word, and the index is keyed by status
+		// with TTL as its range key
+		paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String("TTLIndex"),
+			KeyConditionExpression: aws.String("#status = :status AND #ttl <= :now"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "status",
+				"#ttl":    "TTL",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", currentTime),
+				},
+				":status": &types.AttributeValueMemberS{Value: status},
+			},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			var entries []provisionenv.StateEntry
+			if err := attributevalue.UnmarshalListOfMaps(page.Items, &entries); err != nil {
+				return nil, err
+			}
+			instances = append(instances, entries...)
+		}
+	}
+
+	return instances, nil
 }
 
 func terminateInstance(ctx context.Context, client *ec2.Client, instance provisionenv.StateEntry) error {
@@ -118,13 +204,54 @@ func terminateInstance(ctx context.Context, client *ec2.Client, instance provisi
 	return err
 }
 
-func MarkInstanceAsTerminated(ctx context.Context, client *dynamodb.Client, instanceID string, environment string, tableType string) error {
+// MarkInstanceAsTerminated sets the status of the given record to TERMINATED
+// and returns its environment and vCPUs to the team's quota in the same
+// transaction. A record that is already terminated is left alone, so the
+// quota is never returned twice. Records without a team predate quotas and
+// only have their status updated.
+func MarkInstanceAsTerminated(ctx context.Context, client *dynamodb.Client, instanceID string, team string, vcpus int, tableName string) error {
+	if team == "" {
+		return UpdateInstanceStatus(ctx, client, instanceID, provisionenv.StatusTerminated, tableName)
+	}
 
-	tableName, err := ssm.TableName(environment, tableType)
-	if err != nil {
-		return fmt.Errorf("failed to get table name: %w", err)
+	_, err := client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName: aws.String(tableName),
+					Key: map[string]types.AttributeValue{
+						"ID": &types.AttributeValueMemberS{Value: instanceID},
+					},
+					UpdateExpression:    aws.String("SET #status = :status, status_changed_at = :now"),
+					ConditionExpression: aws.String("#status <> :status"),
+					ExpressionAttributeNames: map[string]string{
+						"#status": "status",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":status": &types.AttributeValueMemberS{Value: provisionenv.StatusTerminated},
+						":now":    &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+					},
+				},
+			},
+			{Update: quota.ReleaseUpdate(tableName, team, vcpus)},
+		},
+	})
+
+	// The status check is the only condition, so a cancelled transaction
+	// whose first item failed it means the record was already terminated
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+		aws.StringValue(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return nil
 	}
 
+	return err
+}
+
+// UpdateInstanceStatus sets the lifecycle status of the record with the given
+// provision ID.
+func UpdateInstanceStatus(ctx context.Context, client *dynamodb.Client, instanceID string, status string, tableName string) error {
+
 	input := &dynamodb.UpdateItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]types.AttributeValue{
@@ -132,18 +259,21 @@ func MarkInstanceAsTerminated(ctx context.Context, client *dynamodb.Client, inst
 				Value: instanceID,
 			},
 		},
-		UpdateExpression: aws.String("SET #status = :status"),
+		UpdateExpression: aws.String("SET #status = :status, status_changed_at = :now"),
 		ExpressionAttributeNames: map[string]string{
 			"#status": "status",
 		},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":status": &types.AttributeValueMemberS{
-				Value: "TERMINATED",
+				Value: status,
+			},
+			":now": &types.AttributeValueMemberS{
+				Value: time.Now().UTC().Format(time.RFC3339Nano),
 			},
 		},
 	}
 
-	_, err = client.UpdateItem(ctx, input)
+	_, err := client.UpdateItem(ctx, input)
 
 	return err
 }
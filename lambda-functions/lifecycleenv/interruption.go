@@ -0,0 +1,153 @@
+package lifecycleenv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/audit"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/cleanupenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/30Piraten/aws-dynamicEventBuilder/metrics"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// SpotInterruptionDetailType is the detail type of the EventBridge event
+// EC2 sends two minutes before it reclaims a spot instance
+const SpotInterruptionDetailType = "EC2 Spot Instance Interruption Warning"
+
+// spotInterruption is the detail of a spot interruption warning
+type spotInterruption struct {
+	InstanceID     string `json:"instance-id"`
+	InstanceAction string `json:"instance-action"`
+}
+
+// NewInterruptionHandler returns the handler for spot interruption
+// warnings. An interrupted environment cannot be kept, so it is ended as
+// if it was torn down: its record is marked as terminated, the quota is
+// returned to the team and the interruption is recorded in the audit
+// trail.
+func NewInterruptionHandler(cfg *appconfig.Config) func(context.Context, events.CloudWatchEvent) error {
+	return func(ctx context.Context, event events.CloudWatchEvent) error {
+		return handleInterruption(ctx, cfg, event)
+	}
+}
+
+func handleInterruption(ctx context.Context, cfg *appconfig.Config, event events.CloudWatchEvent) error {
+	ctx = logging.WithLambdaRequest(ctx)
+
+	if event.DetailType != SpotInterruptionDetailType {
+		logging.Warn(ctx, "Ignoring unexpected event", logging.Fields{"detail_type": event.DetailType})
+		return nil
+	}
+
+	var detail spotInterruption
+	if err := json.Unmarshal(event.Detail, &detail); err != nil {
+		return fmt.Errorf("failed to parse spot interruption: %w", err)
+	}
+	fields := logging.Fields{
+		logging.InstanceID: detail.InstanceID,
+		logging.Region:     event.Region,
+		"instance_action":  detail.InstanceAction,
+	}
+
+	dynamoClient, err := awsclient.Default().DynamoDB(ctx, awsclient.HomeRegion)
+	if err != nil {
+		return fmt.Errorf("failed to load SDK configuration, %v", err)
+	}
+
+	entry, err := findLiveByInstance(ctx, dynamoClient, cfg.TrackingTable, detail.InstanceID)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		// Spot instances the service did not launch are none of its business
+		logging.Debug(ctx, "Interrupted instance is not tracked", fields)
+		return nil
+	}
+	ctx = logging.WithField(ctx, logging.ProvisionID, entry.ID)
+	fields[logging.Environment] = entry.Environment
+
+	recorder := metrics.NewRecorder()
+	defer recorder.Flush(ctx)
+	recorder.Count(metrics.SpotInterruptions, 1, metrics.Dimensions{
+		Environment:  entry.Environment,
+		Region:       entry.Region,
+		InstanceType: entry.InstanceType,
+	})
+
+	// The service launches spot instances to terminate on interruption.
+	// Any other action leaves the instance, so the record stays live.
+	after := map[string]string{"status": entry.Status}
+	if detail.InstanceAction == "terminate" {
+		if err := cleanupenv.MarkInstanceAsTerminated(ctx, dynamoClient, entry.ID, entry.Team, entry.VCPUs, cfg.TrackingTable); err != nil {
+			return fmt.Errorf("failed to update instance status: %w", err)
+		}
+		after["status"] = provisionenv.StatusTerminated
+		recorder.Count(metrics.InstancesTerminated, 1, metrics.Dimensions{
+			Environment: entry.Environment,
+			Region:      entry.Region,
+			Outcome:     metrics.OutcomeSuccess,
+		})
+	}
+
+	if err := audit.Record(ctx, cfg.EventsTable, audit.Event{
+		Environment: cfg.Environment,
+		Action:      audit.ActionSpotInterruption,
+		Actor:       audit.ActorSpot,
+		ProvisionID: entry.ID,
+		InstanceID:  entry.InstanceID,
+		Before:      map[string]string{"status": entry.Status},
+		After:       after,
+		Reason:      fmt.Sprintf("spot interruption, instance action %s", detail.InstanceAction),
+	}); err != nil {
+		logging.Error(ctx, "Failed to record audit event", err, fields)
+	}
+
+	logging.Info(ctx, "Spot instance interrupted", fields)
+	return nil
+}
+
+// findLiveByInstance returns the record of the instance that is not yet
+// terminated, nil when there is none. It queries the InstanceIndex, keyed
+// by instance_id.
+func findLiveByInstance(ctx context.Context, client *dynamodb.Client, tableName string, instanceID string) (*provisionenv.StateEntry, error) {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("InstanceIndex"),
+		KeyConditionExpression: aws.String("instance_id = :instance_id"),
+		FilterExpression:       aws.String("#status <> :terminated"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":instance_id": &types.AttributeValueMemberS{Value: instanceID},
+			":terminated":  &types.AttributeValueMemberS{Value: provisionenv.StatusTerminated},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up instance %s: %w", instanceID, err)
+		}
+		if len(page.Items) == 0 {
+			continue
+		}
+
+		var entry provisionenv.StateEntry
+		if err := attributevalue.UnmarshalMap(page.Items[0], &entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal environment: %w", err)
+		}
+		return &entry, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,384 @@
+package lifecycleenv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/audit"
+	"github.com/30Piraten/aws-dynamicEventBuilder/auth"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/30Piraten/aws-dynamicEventBuilder/cost"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/cleanupenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/30Piraten/aws-dynamicEventBuilder/metrics"
+	"github.com/30Piraten/aws-dynamicEventBuilder/policy"
+	"github.com/30Piraten/aws-dynamicEventBuilder/quota"
+	"github.com/30Piraten/aws-dynamicEventBuilder/redact"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Lifecycle actions on a provisioned environment
+const (
+	ActionTeardown = "teardown"
+	ActionExtend   = "extend"
+	ActionPin      = "pin"
+)
+
+// lifecycleRequest is the body of a lifecycle request
+type lifecycleRequest struct {
+	ProvisionID string `json:"provision_id"`
+	Action      string `json:"action"`
+
+	// Hours moves the expiry of an extend request
+	Hours int64 `json:"hours"`
+
+	// Pinned pins (the default) or unpins the environment of a pin request
+	Pinned *bool `json:"pinned"`
+}
+
+// errTerminated is returned when the record was terminated concurrently
+var errTerminated = errors.New("environment is terminated")
+
+// unbounded is the lifetime in hours of a pinned environment
+const unbounded = math.MaxInt64
+
+// NewLifecycleHandler returns the handler for tearing down, extending and
+// pinning an environment. Only the owner of the environment or a member
+// of one of the admin groups may do so.
+func NewLifecycleHandler(cfg *appconfig.Config) func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	return func(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+		return handleLifecycle(ctx, cfg, event)
+	}
+}
+
+func handleLifecycle(ctx context.Context, cfg *appconfig.Config, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	ctx = logging.WithLambdaRequest(ctx)
+	ctx = logging.WithField(ctx, logging.APIRequestID, event.RequestContext.RequestID)
+
+	var req lifecycleRequest
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		return jsonResponse(400, map[string]any{"success": false, "message": "invalid request format"}), nil
+	}
+	if req.ProvisionID == "" {
+		return jsonResponse(400, map[string]any{"success": false, "message": "provision_id is required"}), nil
+	}
+	switch req.Action {
+	case ActionTeardown, ActionPin:
+	case ActionExtend:
+		if req.Hours <= 0 {
+			return jsonResponse(400, map[string]any{"success": false, "message": "hours must be a positive number"}), nil
+		}
+	default:
+		return jsonResponse(400, map[string]any{"success": false, "message": fmt.Sprintf("unknown action %q", req.Action)}), nil
+	}
+	ctx = logging.WithField(ctx, logging.ProvisionID, req.ProvisionID)
+
+	caller, ok := auth.FromRequest(event)
+	if !ok {
+		return jsonResponse(401, map[string]any{"success": false, "message": "authentication required"}), nil
+	}
+	ctx = logging.WithField(ctx, "caller", caller.ID)
+	ctx = logging.WithField(ctx, "caller_name", caller.Name)
+
+	dynamoClient, err := awsclient.Default().DynamoDB(ctx, awsclient.HomeRegion)
+	if err != nil {
+		return jsonResponse(500, map[string]any{"success": false, "message": "failed to initialise AWS config"}), redact.Default().Error(err)
+	}
+
+	entry, err := provisionenv.LoadState(ctx, dynamoClient, req.ProvisionID, cfg.TrackingTable)
+	if err != nil {
+		logging.Error(ctx, "Failed to load environment", err)
+		return jsonResponse(500, map[string]any{"success": false, "message": "failed to load environment"}), redact.Default().Error(err)
+	}
+	if entry == nil {
+		return jsonResponse(404, map[string]any{"success": false, "message": "environment not found"}), nil
+	}
+
+	if caller.ID != entry.Owner && !caller.InGroup(cfg.AdminGroups) {
+		logging.Warn(ctx, "Lifecycle request denied", logging.Fields{"action": req.Action, "owner": entry.Owner})
+		return jsonResponse(403, map[string]any{"success": false, "message": "only the owner or an admin may " + req.Action + " this environment"}), nil
+	}
+
+	if entry.Status == provisionenv.StatusTerminated {
+		return jsonResponse(409, map[string]any{"success": false, "message": "environment is already terminated"}), nil
+	}
+
+	var record audit.Event
+	switch req.Action {
+	case ActionTeardown:
+		record, err = teardown(ctx, cfg, dynamoClient, entry)
+	case ActionExtend:
+		var resp *events.APIGatewayV2HTTPResponse
+		record, resp, err = extend(ctx, cfg, dynamoClient, entry, req.Hours)
+		if resp != nil {
+			return *resp, nil
+		}
+	case ActionPin:
+		pinned := req.Pinned == nil || *req.Pinned
+		var resp *events.APIGatewayV2HTTPResponse
+		record, resp, err = pin(ctx, cfg, dynamoClient, entry, pinned, caller.InGroup(cfg.AdminGroups))
+		if resp != nil {
+			return *resp, nil
+		}
+	}
+	if errors.Is(err, errTerminated) {
+		return jsonResponse(409, map[string]any{"success": false, "message": "environment is already terminated"}), nil
+	}
+	if err != nil {
+		logging.Error(ctx, "Lifecycle action failed", err, logging.Fields{"action": req.Action})
+		return jsonResponse(500, map[string]any{"success": false, "message": "failed to " + req.Action + " environment"}), redact.Default().Error(err)
+	}
+
+	// Record the action in the audit trail
+	record.Environment = cfg.Environment
+	record.Actor = caller.ID
+	record.ProvisionID = entry.ID
+	record.InstanceID = entry.InstanceID
+	if err := audit.Record(ctx, cfg.EventsTable, record); err != nil {
+		logging.Error(ctx, "Failed to record audit event", err)
+	}
+
+	logging.Info(ctx, "Lifecycle action applied", logging.Fields{
+		"action":            req.Action,
+		logging.InstanceID:  entry.InstanceID,
+		logging.Environment: entry.Environment,
+	})
+
+	return jsonResponse(200, map[string]any{
+		"success":      true,
+		"action":       req.Action,
+		"provision_id": entry.ID,
+		"after":        record.After,
+	}), nil
+}
+
+// teardown terminates the instance in its region and marks the record as
+// terminated, returning the quota to the team
+func teardown(ctx context.Context, cfg *appconfig.Config, dynamoClient *dynamodb.Client, entry *provisionenv.StateEntry) (audit.Event, error) {
+	ec2Client, err := awsclient.Default().EC2(ctx, entry.Region)
+	if err != nil {
+		return audit.Event{}, err
+	}
+
+	recorder := metrics.NewRecorder()
+	defer recorder.Flush(ctx)
+	dims := metrics.Dimensions{
+		Environment: entry.Environment,
+		Region:      entry.Region,
+	}
+
+	if _, err := ec2Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []string{entry.InstanceID},
+	}); err != nil {
+		recorder.Failure(metrics.TerminationFailures, err, dims)
+		dims.Outcome = metrics.OutcomeFailure
+		recorder.Count(metrics.InstancesTerminated, 1, dims)
+		return audit.Event{}, fmt.Errorf("failed to terminate instance: %w", err)
+	}
+	dims.Outcome = metrics.OutcomeSuccess
+	recorder.Count(metrics.InstancesTerminated, 1, dims)
+
+	if err := cleanupenv.MarkInstanceAsTerminated(ctx, dynamoClient, entry.ID, entry.Team, entry.VCPUs, cfg.TrackingTable); err != nil {
+		return audit.Event{}, fmt.Errorf("failed to update instance status: %w", err)
+	}
+
+	return audit.Event{
+		Action: audit.ActionTeardown,
+		Before: map[string]string{"status": entry.Status},
+		After:  map[string]string{"status": provisionenv.StatusTerminated},
+		Reason: "teardown request",
+	}, nil
+}
+
+// extend moves the expiry of the environment by hours. The total lifetime
+// stays within the team's quota and the environment's policy; a request
+// beyond either gets the returned response.
+func extend(ctx context.Context, cfg *appconfig.Config, dynamoClient *dynamodb.Client, entry *provisionenv.StateEntry, hours int64) (audit.Event, *events.APIGatewayV2HTTPResponse, error) {
+	expiresAt := entry.ExpiresAt.Add(time.Duration(hours) * time.Hour)
+	lifetime := int64(math.Ceil(expiresAt.Sub(entry.CreatedAt).Hours()))
+
+	if resp, err := checkLifetime(ctx, cfg, entry, lifetime); resp != nil || err != nil {
+		return audit.Event{}, resp, err
+	}
+
+	// A pinned record keeps having no TTL attribute
+	update := "SET expires_at = :expires_at"
+	values := map[string]types.AttributeValue{
+		":expires_at": &types.AttributeValueMemberS{Value: expiresAt.Format(time.RFC3339Nano)},
+	}
+	update += estimateCost(ctx, entry, expiresAt, entry.Pinned, values)
+	if !entry.Pinned {
+		update += ", #ttl = :ttl"
+		values[":ttl"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)}
+	}
+	if err := updateLive(ctx, dynamoClient, cfg.TrackingTable, entry.ID, update, values); err != nil {
+		return audit.Event{}, nil, err
+	}
+
+	// The ExpiresAt tag only informs, so failing to update it is logged
+	if ec2Client, err := awsclient.Default().EC2(ctx, entry.Region); err == nil {
+		if _, err := ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: []string{entry.InstanceID},
+			Tags:      []ec2Types.Tag{{Key: aws.String("ExpiresAt"), Value: aws.String(expiresAt.Format(time.RFC3339))}},
+		}); err != nil {
+			logging.Warn(ctx, "Failed to update ExpiresAt tag", logging.Fields{logging.InstanceID: entry.InstanceID, "error": err.Error()})
+		}
+	}
+
+	return audit.Event{
+		Action: audit.ActionExtend,
+		Before: map[string]string{"expires_at": entry.ExpiresAt.Format(time.RFC3339)},
+		After:  map[string]string{"expires_at": expiresAt.Format(time.RFC3339)},
+		Reason: fmt.Sprintf("extended by %d hours", hours),
+	}, nil, nil
+}
+
+// pin pins or unpins the environment. Pinning removes the TTL attribute,
+// so the record drops out of the TTL index and is not cleaned up;
+// unpinning restores it from the expiry. Only admins may pin beyond the
+// maximum lifetime of the team's quota or the environment's policy; for
+// anyone else pinning gets the returned response unless neither has one.
+func pin(ctx context.Context, cfg *appconfig.Config, dynamoClient *dynamodb.Client, entry *provisionenv.StateEntry, pinned bool, admin bool) (audit.Event, *events.APIGatewayV2HTTPResponse, error) {
+	if pinned && !admin {
+		if resp, err := checkLifetime(ctx, cfg, entry, unbounded); resp != nil || err != nil {
+			return audit.Event{}, resp, err
+		}
+	}
+
+	values := map[string]types.AttributeValue{
+		":pinned": &types.AttributeValueMemberBOOL{Value: pinned},
+	}
+	update := "SET pinned = :pinned" + estimateCost(ctx, entry, entry.ExpiresAt, pinned, values)
+	if pinned {
+		update += " REMOVE #ttl"
+	} else {
+		update += ", #ttl = :ttl"
+		values[":ttl"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(entry.ExpiresAt.Unix(), 10)}
+	}
+
+	if err := updateLive(ctx, dynamoClient, cfg.TrackingTable, entry.ID, update, values); err != nil {
+		return audit.Event{}, nil, err
+	}
+
+	return audit.Event{
+		Action: audit.ActionPin,
+		Before: map[string]string{"pinned": strconv.FormatBool(entry.Pinned)},
+		After:  map[string]string{"pinned": strconv.FormatBool(pinned)},
+		Reason: "pin request",
+	}, nil, nil
+}
+
+// estimateCost returns the SET actions storing the estimated cost of the
+// environment from its creation to expiresAt, adding their values. A
+// pinned environment runs past expiresAt, so its estimate is marked
+// open-ended. Without a price the record is left as it is.
+func estimateCost(ctx context.Context, entry *provisionenv.StateEntry, expiresAt time.Time, openEnded bool, values map[string]types.AttributeValue) string {
+	estimate, err := cost.Default().Estimate(entry.Region, entry.InstanceType, 1, expiresAt.Sub(entry.CreatedAt).Hours())
+	if err != nil {
+		logging.Warn(ctx, "No cost estimate for environment", logging.Fields{"error": err.Error()})
+		return ""
+	}
+
+	values[":estimated_cost"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(estimate.Total, 'f', -1, 64)}
+	values[":cost_currency"] = &types.AttributeValueMemberS{Value: estimate.Currency}
+	values[":cost_open_ended"] = &types.AttributeValueMemberBOOL{Value: openEnded}
+	return ", estimated_cost = :estimated_cost, cost_currency = :cost_currency, cost_open_ended = :cost_open_ended"
+}
+
+// checkLifetime checks a lifetime in hours against the team's quota and
+// the environment's policy. A lifetime beyond either gets the returned
+// response.
+func checkLifetime(ctx context.Context, cfg *appconfig.Config, entry *provisionenv.StateEntry, lifetime int64) (*events.APIGatewayV2HTTPResponse, error) {
+	if err := quota.CheckTTL(entry.Team, cfg.QuotaFor(entry.Team), lifetime); err != nil {
+		resp := jsonResponse(429, map[string]any{"success": false, "message": "Quota exceeded", "error": err.Error(), "quota": err})
+		return &resp, nil
+	}
+
+	p, err := cfg.Policy(ctx, entry.Environment)
+	if err != nil {
+		return nil, err
+	}
+	var violations []policy.Violation
+	switch {
+	case p == nil:
+		violations = append(violations, policy.Missing(entry.Environment))
+	case p.MaxTTLHours > 0 && lifetime == unbounded:
+		violations = append(violations, policy.Violation{
+			Field:   "pinned",
+			Rule:    policy.RuleMaxTTL,
+			Message: fmt.Sprintf("pinning exceeds the maximum lifetime of %d hours", p.MaxTTLHours),
+		})
+	case p.MaxTTLHours > 0 && lifetime > p.MaxTTLHours:
+		violations = append(violations, policy.Violation{
+			Field:   "hours",
+			Rule:    policy.RuleMaxTTL,
+			Message: fmt.Sprintf("lifetime of %d hours exceeds the maximum of %d", lifetime, p.MaxTTLHours),
+		})
+	}
+	if len(violations) > 0 {
+		resp := jsonResponse(403, map[string]any{
+			"success":    false,
+			"message":    "Request violates the environment policy",
+			"violations": violations,
+		})
+		return &resp, nil
+	}
+	return nil, nil
+}
+
+// updateLive applies the update to a record that is not terminated. It
+// returns errTerminated when the record was terminated in the meantime.
+func updateLive(ctx context.Context, client *dynamodb.Client, tableName string, provisionID string, update string, values map[string]types.AttributeValue) error {
+	values[":terminated"] = &types.AttributeValueMemberS{Value: provisionenv.StatusTerminated}
+
+	// DynamoDB rejects names the expressions do not use
+	names := map[string]string{"#status": "status"}
+	if strings.Contains(update, "#ttl") {
+		names["#ttl"] = "TTL"
+	}
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: provisionID},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("#status <> :terminated"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return errTerminated
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update environment: %w", err)
+	}
+	return nil
+}
+
+// jsonResponse returns an API Gateway response with body encoded as JSON
+func jsonResponse(statusCode int, body any) events.APIGatewayV2HTTPResponse {
+	encoded, _ := json.Marshal(body)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Body:       string(encoded),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package provisionenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// ssmPrefix marks an AMI given as an SSM parameter, the way launch
+// templates write it
+const ssmPrefix = "resolve:ssm:"
+
+// publicParameterPrefixes are the SSM paths an AMI may be read from. They
+// hold AWS's public parameters only, so a caller cannot use an AMI alias
+// to read the service's own, private parameters.
+var publicParameterPrefixes = []string{"/aws/service/"}
+
+// imageOwnerName matches the owner of a name filter: an account ID or
+// an owner alias such as amazon, aws-marketplace or self
+var imageOwnerName = regexp.MustCompile(`^(\d{12}|[a-z][a-z-]*)$`)
+
+// errUnresolvedAMI is returned when an AMI alias resolves to no image
+var errUnresolvedAMI = errors.New("AMI alias does not resolve to an image")
+
+// resolveAMI returns the image ID an AMI alias stands for in region. The
+// AMI may be given as
+//
+//   - an image ID such as ami-0abcdef1234567890, returned as is
+//   - a public SSM parameter path such as
+//     /aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64,
+//     optionally prefixed with resolve:ssm:
+//   - an owner and a name pattern such as amazon/al2023-ami-2023.*-x86_64,
+//     resolved to the newest matching image. The owner is required, so
+//     that a public image of someone else with a matching name is never
+//     picked up.
+//
+// An empty AMI is returned as is, leaving it to the launch template.
+func resolveAMI(ctx context.Context, client *ec2.Client, region string, ami string) (string, error) {
+	switch {
+	case ami == "" || imageID.MatchString(ami):
+		return ami, nil
+	case strings.HasPrefix(ami, ssmPrefix) || strings.HasPrefix(ami, "/"):
+		return imageFromParameter(ctx, region, strings.TrimPrefix(ami, ssmPrefix))
+	}
+
+	owner, name, ok := strings.Cut(ami, "/")
+	if !ok || name == "" || !imageOwnerName.MatchString(owner) {
+		return "", fmt.Errorf("%w: %q is neither an image ID, an SSM parameter nor owner/name-pattern", errUnresolvedAMI, ami)
+	}
+	return newestImage(ctx, client, owner, name)
+}
+
+// imageFromParameter reads an image ID from an SSM parameter. Public
+// parameters differ per region, so the parameter is read in the region
+// the instance is launched in. Only public parameters are read, and their
+// value never ends up in an error.
+func imageFromParameter(ctx context.Context, region string, name string) (string, error) {
+	if !isPublicParameter(name) {
+		return "", fmt.Errorf("%w: parameter %s is not under %s", errUnresolvedAMI, name, strings.Join(publicParameterPrefixes, ", "))
+	}
+
+	client, err := awsclient.Default().SSM(ctx, region)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	if appconfig.IsNotFound(err) {
+		return "", fmt.Errorf("%w: parameter %s not found", errUnresolvedAMI, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read AMI parameter %s: %w", name, err)
+	}
+
+	id := aws.StringValue(result.Parameter.Value)
+	if !imageID.MatchString(id) {
+		return "", fmt.Errorf("%w: parameter %s does not hold an image ID", errUnresolvedAMI, name)
+	}
+	return id, nil
+}
+
+// isPublicParameter reports whether name is under one of the public
+// parameter prefixes. Paths with relative elements are rejected.
+func isPublicParameter(name string) bool {
+	if strings.Contains(name, "/../") || strings.Contains(name, "/./") || strings.Contains(name, "//") {
+		return false
+	}
+	for _, prefix := range publicParameterPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// newestImage returns the most recently created available image of owner
+// whose name matches the pattern
+func newestImage(ctx context.Context, client *ec2.Client, owner string, name string) (string, error) {
+	result, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		Owners: []string{owner},
+		Filters: []types.Filter{
+			{Name: aws.String("name"), Values: []string{name}},
+			{Name: aws.String("state"), Values: []string{string(types.ImageStateAvailable)}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe images: %w", err)
+	}
+	if len(result.Images) == 0 {
+		return "", fmt.Errorf("%w: no image of %s matches %q", errUnresolvedAMI, owner, name)
+	}
+
+	// CreationDate is an ISO 8601 timestamp, so it sorts as a string
+	images := result.Images
+	sort.Slice(images, func(i, j int) bool {
+		return aws.StringValue(images[i].CreationDate) > aws.StringValue(images[j].CreationDate)
+	})
+	return aws.StringValue(images[0].ImageId), nil
+}
@@ -0,0 +1,259 @@
+package provisionenv
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/policy"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// RootVolume configures the root EBS volume. Zero values keep what the
+// AMI or launch template specifies.
+type RootVolume struct {
+	SizeGiB   int32  `json:"size_gib,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Encrypted *bool  `json:"encrypted,omitempty"`
+	KMSKeyID  string `json:"kms_key_id,omitempty"`
+
+	// IOPS is the provisioned IOPS, required for io1 and io2 volumes and
+	// optional for gp3
+	IOPS int32 `json:"iops,omitempty"`
+}
+
+// MetadataOptions configures the instance metadata service. HTTPTokens
+// defaults to "required", allowing IMDSv2 only.
+type MetadataOptions struct {
+	HTTPTokens   string `json:"http_tokens,omitempty"`
+	HTTPEndpoint string `json:"http_endpoint,omitempty"`
+	HopLimit     int32  `json:"hop_limit,omitempty"`
+}
+
+// Limits of the instance options
+const (
+	maxSecurityGroups = 16
+	maxVolumeSizeGiB  = 16384
+	maxHopLimit       = 64
+)
+
+// iopsVolumeTypes take provisioned IOPS, the required ones mapped to true
+var iopsVolumeTypes = map[types.VolumeType]bool{
+	types.VolumeTypeIo1: true,
+	types.VolumeTypeIo2: true,
+	types.VolumeTypeGp3: false,
+}
+
+var (
+	securityGroupID    = regexp.MustCompile(`^sg-[0-9a-f]{8,17}$`)
+	instanceProfileARN = regexp.MustCompile(`^arn:aws[a-zA-Z-]*:iam::\d{12}:instance-profile/[\w+=,.@/-]+$`)
+	instanceProfile    = regexp.MustCompile(`^[\w+=,.@-]{1,128}$`)
+	imageID            = regexp.MustCompile(`^ami-[0-9a-f]+$`)
+)
+
+// Rules reported for invalid instance options
+const (
+	RuleSecurityGroup   = "security_group"
+	RuleInstanceProfile = "instance_profile"
+	RuleRootVolume      = "root_volume"
+	RuleMetadata        = "metadata"
+)
+
+// validateInstanceOptions checks the security groups, instance profile,
+// root volume and metadata options of a request and returns every
+// problem found
+func validateInstanceOptions(config EC2Config) []policy.Violation {
+	var violations []policy.Violation
+	add := func(field, rule, format string, args ...any) {
+		violations = append(violations, policy.Violation{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(config.SecurityGroupIDs) > maxSecurityGroups {
+		add("ec2.security_group_ids", RuleSecurityGroup, "at most %d security groups are allowed, got %d", maxSecurityGroups, len(config.SecurityGroupIDs))
+	}
+	for _, id := range config.SecurityGroupIDs {
+		if !securityGroupID.MatchString(id) {
+			add("ec2.security_group_ids", RuleSecurityGroup, "%q is not a security group ID", id)
+		}
+	}
+
+	if p := config.InstanceProfile; p != "" && !instanceProfileARN.MatchString(p) && !instanceProfile.MatchString(p) {
+		add("ec2.instance_profile", RuleInstanceProfile, "%q is neither an instance profile name nor ARN", p)
+	}
+
+	if v := config.RootVolume; v != nil {
+		// A zero size keeps the size of the AMI or launch template
+		if v.SizeGiB != 0 && (v.SizeGiB < 1 || v.SizeGiB > maxVolumeSizeGiB) {
+			add("ec2.root_volume.size_gib", RuleRootVolume, "size must be between 1 and %d GiB", maxVolumeSizeGiB)
+		}
+		if v.Type != "" && !oneOf(v.Type, types.VolumeType("").Values()) {
+			add("ec2.root_volume.type", RuleRootVolume, "unknown volume type %q", v.Type)
+		}
+		required, takesIOPS := iopsVolumeTypes[types.VolumeType(v.Type)]
+		switch {
+		case v.IOPS < 0:
+			add("ec2.root_volume.iops", RuleRootVolume, "iops must be positive")
+		case required && v.IOPS == 0:
+			add("ec2.root_volume.iops", RuleRootVolume, "a %s volume requires iops", v.Type)
+		case v.IOPS > 0 && !takesIOPS:
+			add("ec2.root_volume.iops", RuleRootVolume, "iops requires a volume type of io1, io2 or gp3")
+		}
+		if v.KMSKeyID != "" && (v.Encrypted == nil || !*v.Encrypted) {
+			add("ec2.root_volume.kms_key_id", RuleRootVolume, "a KMS key requires encrypted to be true")
+		}
+	}
+
+	if m := config.Metadata; m != nil {
+		if m.HTTPTokens != "" && !oneOf(m.HTTPTokens, types.HttpTokensState("").Values()) {
+			add("ec2.metadata.http_tokens", RuleMetadata, "http_tokens must be required or optional")
+		}
+		if m.HTTPEndpoint != "" && !oneOf(m.HTTPEndpoint, types.InstanceMetadataEndpointState("").Values()) {
+			add("ec2.metadata.http_endpoint", RuleMetadata, "http_endpoint must be enabled or disabled")
+		}
+		if m.HopLimit != 0 && (m.HopLimit < 1 || m.HopLimit > maxHopLimit) {
+			add("ec2.metadata.hop_limit", RuleMetadata, "hop_limit must be between 1 and %d", maxHopLimit)
+		}
+	}
+
+	return violations
+}
+
+// oneOf reports whether value is one of the enum values
+func oneOf[T ~string](value string, values []T) bool {
+	for _, v := range values {
+		if string(v) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceProfileSpec returns the instance profile for RunInstances, nil
+// when the request names none
+func instanceProfileSpec(profile string) *types.IamInstanceProfileSpecification {
+	switch {
+	case profile == "":
+		return nil
+	case instanceProfileARN.MatchString(profile):
+		return &types.IamInstanceProfileSpecification{Arn: aws.String(profile)}
+	default:
+		return &types.IamInstanceProfileSpecification{Name: aws.String(profile)}
+	}
+}
+
+// metadataOptions returns the metadata options for RunInstances. Unless
+// the request explicitly allows IMDSv1, only IMDSv2 is enabled, also over
+// a launch template that allows both.
+func metadataOptions(m *MetadataOptions) *types.InstanceMetadataOptionsRequest {
+	options := &types.InstanceMetadataOptionsRequest{HttpTokens: types.HttpTokensStateRequired}
+	if m == nil {
+		return options
+	}
+	if m.HTTPTokens != "" {
+		options.HttpTokens = types.HttpTokensState(m.HTTPTokens)
+	}
+	if m.HTTPEndpoint != "" {
+		options.HttpEndpoint = types.InstanceMetadataEndpointState(m.HTTPEndpoint)
+	}
+	if m.HopLimit > 0 {
+		options.HttpPutResponseHopLimit = aws.Int32(m.HopLimit)
+	}
+	return options
+}
+
+// blockDeviceMappings returns the EBS volumes of the instance, from the
+// AMI and the launch template, with the root volume options applied.
+// Every volume is deleted on termination, so cleanup leaves no orphaned
+// volumes behind.
+func blockDeviceMappings(ctx context.Context, client *ec2.Client, config EC2Config) ([]types.BlockDeviceMapping, error) {
+	var (
+		rootDevice string
+		devices    []string
+		mappings   = make(map[string]*types.BlockDeviceMapping)
+	)
+	mapping := func(device string) *types.BlockDeviceMapping {
+		m, ok := mappings[device]
+		if !ok {
+			m = &types.BlockDeviceMapping{DeviceName: aws.String(device), Ebs: &types.EbsBlockDevice{}}
+			mappings[device] = m
+			devices = append(devices, device)
+		}
+		return m
+	}
+
+	// Volumes of the AMI inherit their settings from its snapshots. The
+	// AMI is resolved to an image ID by now.
+	if imageID.MatchString(config.AMI) {
+		result, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+			ImageIds: []string{config.AMI},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe AMI %s: %w", config.AMI, err)
+		}
+		if len(result.Images) == 0 {
+			return nil, fmt.Errorf("AMI %s not found", config.AMI)
+		}
+		image := result.Images[0]
+
+		rootDevice = aws.StringValue(image.RootDeviceName)
+		for _, bdm := range image.BlockDeviceMappings {
+			if bdm.Ebs != nil {
+				mapping(aws.StringValue(bdm.DeviceName))
+			}
+		}
+	}
+
+	// The template's volumes are replaced by the mappings passed at
+	// launch, so they are carried over with their settings
+	for _, bdm := range config.templateVolumes {
+		if bdm.Ebs == nil {
+			continue
+		}
+		m := mapping(aws.StringValue(bdm.DeviceName))
+		m.Ebs.VolumeSize = bdm.Ebs.VolumeSize
+		m.Ebs.VolumeType = bdm.Ebs.VolumeType
+		m.Ebs.Encrypted = bdm.Ebs.Encrypted
+		m.Ebs.KmsKeyId = bdm.Ebs.KmsKeyId
+		m.Ebs.Iops = bdm.Ebs.Iops
+		m.Ebs.Throughput = bdm.Ebs.Throughput
+		m.Ebs.SnapshotId = bdm.Ebs.SnapshotId
+	}
+
+	if v := config.RootVolume; v != nil {
+		if rootDevice == "" {
+			return nil, fmt.Errorf("the root device of AMI %q is unknown", config.AMI)
+		}
+		m := mapping(rootDevice)
+		if v.SizeGiB > 0 {
+			m.Ebs.VolumeSize = aws.Int32(v.SizeGiB)
+		}
+		if v.Type != "" {
+			m.Ebs.VolumeType = types.VolumeType(v.Type)
+
+			// IOPS carried over from the template do not apply to a type
+			// without provisioned IOPS
+			if _, ok := iopsVolumeTypes[m.Ebs.VolumeType]; !ok {
+				m.Ebs.Iops = nil
+			}
+		}
+		if v.IOPS > 0 {
+			m.Ebs.Iops = aws.Int32(v.IOPS)
+		}
+		if v.Encrypted != nil {
+			m.Ebs.Encrypted = v.Encrypted
+		}
+		if v.KMSKeyID != "" {
+			m.Ebs.KmsKeyId = aws.String(v.KMSKeyID)
+		}
+	}
+
+	result := make([]types.BlockDeviceMapping, 0, len(devices))
+	for _, device := range devices {
+		m := mappings[device]
+		m.Ebs.DeleteOnTermination = aws.Bool(true)
+		result = append(result, *m)
+	}
+	return result, nil
+}
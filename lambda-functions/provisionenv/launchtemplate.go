@@ -0,0 +1,155 @@
+package provisionenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Launch template versions that EC2 resolves itself
+const (
+	VersionDefault = "$Default"
+	VersionLatest  = "$Latest"
+)
+
+// errNetworkConflict is returned for a request that sets a subnet or
+// security groups over a launch template with network interfaces. EC2
+// rejects instance-level network settings next to network interfaces.
+var errNetworkConflict = errors.New("the launch template configures network interfaces, so subnet_id and security_group_ids belong in the template")
+
+// LaunchTemplate names the EC2 launch template an instance is launched
+// from, by ID or by name. Version is a version number, $Default or
+// $Latest, and $Default when empty.
+type LaunchTemplate struct {
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// validate checks that exactly one of ID and name is set and that the
+// version is one EC2 accepts. A nil launch template is valid.
+func (t *LaunchTemplate) validate() error {
+	if t == nil {
+		return nil
+	}
+	if (t.ID == "") == (t.Name == "") {
+		return errors.New("exactly one of id and name is required")
+	}
+	switch t.Version {
+	case "", VersionDefault, VersionLatest:
+	default:
+		if n, err := strconv.ParseInt(t.Version, 10, 64); err != nil || n < 1 {
+			return fmt.Errorf("version must be a positive number, %s or %s, got %q", VersionDefault, VersionLatest, t.Version)
+		}
+	}
+	return nil
+}
+
+// version returns the version to launch, $Default when none was given
+func (t *LaunchTemplate) version() string {
+	if t.Version == "" {
+		return VersionDefault
+	}
+	return t.Version
+}
+
+// specification returns the template for RunInstances, nil without one
+func (t *LaunchTemplate) specification() *types.LaunchTemplateSpecification {
+	if t == nil {
+		return nil
+	}
+	spec := &types.LaunchTemplateSpecification{Version: aws.String(t.version())}
+	if t.ID != "" {
+		spec.LaunchTemplateId = aws.String(t.ID)
+	} else {
+		spec.LaunchTemplateName = aws.String(t.Name)
+	}
+	return spec
+}
+
+// resolveLaunchTemplate returns the configuration the instance will be
+// launched with: the request's fields, with the empty ones filled in from
+// the launch template version. The template's instance tags are added to
+// the custom tags, because the service's tag specification replaces them
+// at launch. A request cannot set the subnet or security groups of a
+// template with network interfaces. Without a launch template the request
+// is returned as is.
+func resolveLaunchTemplate(ctx context.Context, client *ec2.Client, config EC2Config) (EC2Config, error) {
+	t := config.LaunchTemplate
+	if t == nil {
+		return config, nil
+	}
+
+	input := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: []string{t.version()},
+	}
+	if t.ID != "" {
+		input.LaunchTemplateId = aws.String(t.ID)
+	} else {
+		input.LaunchTemplateName = aws.String(t.Name)
+	}
+
+	result, err := client.DescribeLaunchTemplateVersions(ctx, input)
+	if err != nil {
+		return config, fmt.Errorf("failed to describe launch template: %w", err)
+	}
+	if len(result.LaunchTemplateVersions) == 0 || result.LaunchTemplateVersions[0].LaunchTemplateData == nil {
+		return config, fmt.Errorf("launch template version %s not found", t.version())
+	}
+	data := result.LaunchTemplateVersions[0].LaunchTemplateData
+
+	if len(data.NetworkInterfaces) > 0 && (config.SubnetID != "" || len(config.SecurityGroupIDs) > 0) {
+		return config, errNetworkConflict
+	}
+
+	resolved := config
+	if resolved.AMI == "" {
+		resolved.AMI = aws.StringValue(data.ImageId)
+	}
+	if resolved.InstanceType == "" {
+		resolved.InstanceType = string(data.InstanceType)
+	}
+	if resolved.KeyName == "" {
+		resolved.KeyName = aws.StringValue(data.KeyName)
+	}
+	if resolved.SubnetID == "" {
+		for _, ni := range data.NetworkInterfaces {
+			if subnet := aws.StringValue(ni.SubnetId); subnet != "" {
+				resolved.SubnetID = subnet
+				break
+			}
+		}
+	}
+	resolved.templateVolumes = data.BlockDeviceMappings
+
+	resolved.Tags = make(map[string]string, len(config.Tags))
+	for k, v := range config.Tags {
+		resolved.Tags[k] = v
+	}
+	for _, spec := range data.TagSpecifications {
+		if spec.ResourceType != types.ResourceTypeInstance {
+			continue
+		}
+		for _, tag := range spec.Tags {
+			key := aws.StringValue(tag.Key)
+
+			// Request tags win, and the template cannot set reserved keys
+			// or push the instance over the tag limit
+			if _, ok := resolved.Tags[key]; ok || isReservedTag(key) || strings.HasPrefix(strings.ToLower(key), "aws:") {
+				continue
+			}
+			if len(resolved.Tags)+len(ReservedTagKeys) >= maxTagsPerResource {
+				break
+			}
+			resolved.Tags[key] = aws.StringValue(tag.Value)
+		}
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,84 @@
+package provisionenv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/30Piraten/aws-dynamicEventBuilder/policy"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// evaluatePolicy evaluates the request against the policy of its
+// environment and returns the violations. An environment without a
+// policy denies every request.
+func evaluatePolicy(ctx context.Context, cfg *appconfig.Config, client *ec2.Client, env string, config EC2Config, ttl int64) ([]policy.Violation, error) {
+	p, err := cfg.Policy(ctx, env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policy: %w", err)
+	}
+	if p == nil {
+		logging.Warn(ctx, "No provision policy for environment", logging.Fields{logging.Environment: env})
+		return []policy.Violation{policy.Missing(env)}, nil
+	}
+
+	req := policy.Request{
+		InstanceType: config.InstanceType,
+		AMI:          config.AMI,
+		SubnetID:     config.SubnetID,
+		TTL:          ttl,
+		Tags:         config.Tags,
+	}
+
+	if p.NeedsAMIOwner() && config.AMI != "" {
+		owner, alias, err := imageOwner(ctx, client, config.AMI)
+		if err != nil {
+			return nil, err
+		}
+		req.AMIOwner = owner
+		req.AMIOwnerAlias = alias
+	}
+
+	return p.Evaluate(req), nil
+}
+
+// imageOwner returns the account that owns the AMI and its owner alias,
+// both empty when EC2 does not know the image
+func imageOwner(ctx context.Context, client *ec2.Client, ami string) (string, string, error) {
+	result, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{ami},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to describe AMI %s: %w", ami, err)
+	}
+	if len(result.Images) == 0 {
+		return "", "", nil
+	}
+	image := result.Images[0]
+	return aws.StringValue(image.OwnerId), aws.StringValue(image.ImageOwnerAlias), nil
+}
+
+// policyViolationResponse returns a 403 response listing every rule the
+// request violates. The Lambda error is nil, so that API Gateway passes
+// the status code on.
+func policyViolationResponse(ctx context.Context, violations []policy.Violation) (events.APIGatewayV2HTTPResponse, error) {
+	logging.Warn(ctx, "Request violates the environment policy", logging.Fields{"violations": violations})
+
+	body, _ := json.Marshal(map[string]any{
+		"success":    false,
+		"message":    "Request violates the environment policy",
+		"violations": violations,
+	})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 403,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}, nil
+}
@@ -3,47 +3,147 @@ package provisionenv
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/audit"
+	"github.com/30Piraten/aws-dynamicEventBuilder/auth"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+	"github.com/30Piraten/aws-dynamicEventBuilder/bootstrap"
+	"github.com/30Piraten/aws-dynamicEventBuilder/cost"
 	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
 	"github.com/30Piraten/aws-dynamicEventBuilder/metrics"
-	"github.com/30Piraten/aws-dynamicEventBuilder/ssm"
+	"github.com/30Piraten/aws-dynamicEventBuilder/policy"
+	"github.com/30Piraten/aws-dynamicEventBuilder/quota"
+	"github.com/30Piraten/aws-dynamicEventBuilder/redact"
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/google/uuid"
 )
 
-// EC2Config is the configuration for the EC2 instance
+// EC2Config is the configuration for the EC2 instance. With a launch
+// template the other fields are optional and override the template.
 type EC2Config struct {
-	InstanceType string            `json:"instanceType"`
-	AMI          string            `json:"ami"`
-	KeyName      string            `json:"key_name"`
-	SubnetID     string            `json:"subnet_id"`
-	Tags         map[string]string `json:"tags"`
+	InstanceType   string            `json:"instanceType"`
+	AMI            string            `json:"ami"`
+	KeyName        string            `json:"key_name"`
+	SubnetID       string            `json:"subnet_id"`
+	Tags           map[string]string `json:"tags"`
+	LaunchTemplate *LaunchTemplate   `json:"launch_template,omitempty"`
+
+	// UserData is a script run at boot. Bootstrap renders a named
+	// template instead; at most one of them may be set.
+	UserData  string     `json:"user_data,omitempty"`
+	Bootstrap *Bootstrap `json:"bootstrap,omitempty"`
+
+	SecurityGroupIDs []string         `json:"security_group_ids,omitempty"`
+	InstanceProfile  string           `json:"instance_profile,omitempty"`
+	RootVolume       *RootVolume      `json:"root_volume,omitempty"`
+	Metadata         *MetadataOptions `json:"metadata,omitempty"`
+
+	// Purchasing is on-demand (the default), spot or spot-with-fallback,
+	// which launches on-demand when no spot capacity is available.
+	// MaxPrice caps the hourly spot price.
+	Purchasing string `json:"purchasing,omitempty"`
+	MaxPrice   string `json:"max_price,omitempty"`
+
+	// templateVolumes are the EBS volumes of the launch template, set by
+	// resolveLaunchTemplate
+	templateVolumes []types.LaunchTemplateBlockDeviceMapping
+}
+
+// launchOptions are the settings of a launch that are derived from the
+// request rather than taken from it as is
+type launchOptions struct {
+	// Tags are the custom tags, including those of the launch template
+	Tags map[string]string
+
+	// UserData is base64 encoded and must not be logged
+	UserData string
+
+	BlockDevices []types.BlockDeviceMapping
 }
 
 // StateEntry is the entry that represents the DynamoDB record
-// for tracking EC2 instances
+// for tracking EC2 instances. The dynamodbav names are the stored schema:
+// the TTLIndex and the table's TTL are defined on status and TTL in
+// Terraform, and cleanup, drift and the lifecycle handlers query status
+// and instance_id. Without the tags the attributes were stored under the
+// Go field names, so no query ever matched them.
 type StateEntry struct {
-	ID          string    `json:"id"`
-	Environment string    `json:"environment"`
-	Region      string    `json:"region"`
-	InstanceID  string    `json:"instance_id"`
-	Status      string    `json:"status"`
-	CreatedAt   time.Time `json:"created_at"`
-	ExpiresAt   time.Time `json:"expires_at"`
-	TTL         int64     `json:"ttl"`
+	ID           string    `json:"id" dynamodbav:"ID"`
+	Environment  string    `json:"environment" dynamodbav:"environment"`
+	Region       string    `json:"region" dynamodbav:"region"`
+	InstanceID   string    `json:"instance_id" dynamodbav:"instance_id"`
+	InstanceType string    `json:"instance_type" dynamodbav:"instance_type"`
+	Owner        string    `json:"owner" dynamodbav:"owner"`
+	Team         string    `json:"team" dynamodbav:"team"`
+	VCPUs        int       `json:"vcpus" dynamodbav:"vcpus"`
+	Status       string    `json:"status" dynamodbav:"status"`
+	CreatedAt    time.Time `json:"created_at" dynamodbav:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at" dynamodbav:"expires_at"`
+	TTL          int64     `json:"ttl" dynamodbav:"TTL"`
+
+	// StatusChangedAt is when the status last changed after provisioning
+	StatusChangedAt time.Time `json:"status_changed_at" dynamodbav:"status_changed_at"`
+
+	// Market is the market the instance runs in, on-demand or spot
+	Market string `json:"market" dynamodbav:"market"`
+
+	// ImageID is the AMI the instance was launched from, with any alias
+	// in the request resolved
+	ImageID string `json:"image_id" dynamodbav:"image_id"`
+
+	// EstimatedCost is the cost of the instance from its creation to its
+	// expiry, in CostCurrency, and is recomputed when the expiry moves. It
+	// is zero when the price table has no price for the region and
+	// instance type.
+	EstimatedCost float64 `json:"estimated_cost,omitempty" dynamodbav:"estimated_cost,omitempty"`
+	CostCurrency  string  `json:"cost_currency,omitempty" dynamodbav:"cost_currency,omitempty"`
+
+	// CostOpenEnded is set while the environment is pinned: it runs past
+	// its expiry, so EstimatedCost is only a lower bound
+	CostOpenEnded bool `json:"cost_open_ended,omitempty" dynamodbav:"cost_open_ended,omitempty"`
+
+	// Pinned records have no TTL attribute, so neither expiry cleanup nor
+	// DynamoDB's own TTL removes them
+	Pinned bool `json:"pinned,omitempty" dynamodbav:"pinned,omitempty"`
 }
 
-// HandleProvisionRequest is the handler for the provisoning
+// Lifecycle statuses stored on a StateEntry. Every EC2 instance
+// state maps onto one of these, see monitordrift.
+const (
+	StatusActive     = "ACTIVE"
+	StatusStopped    = "STOPPED"
+	StatusTerminated = "TERMINATED"
+)
+
+// RuleTeam is reported when a non-admin names a team other than the
+// deployment's
+const RuleTeam = "team"
+
+// NewProvisionHandler returns the handler for the provisoning
 // the EC2 instance and storing the state in DynamoDB
-func HandleProvisionRequest(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func NewProvisionHandler(cfg *appconfig.Config) func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	return func(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+		return handleProvision(ctx, cfg, event)
+	}
+}
+
+func handleProvision(ctx context.Context, cfg *appconfig.Config, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+	requestedAt := requestTime(event)
+
+	// Correlate every log entry of this request
+	ctx = logging.WithLambdaRequest(ctx)
+	ctx = logging.WithField(ctx, logging.APIRequestID, event.RequestContext.RequestID)
 
 	// Parse the request
 	var req struct {
@@ -51,98 +151,400 @@ func HandleProvisionRequest(ctx context.Context, event events.APIGatewayProxyReq
 		Region      string    `json:"region"`
 		EC2         EC2Config `json:"ec2"`
 		TTL         int64     `json:"ttl"`
+
+		// Team the request is counted against. Requests count against the
+		// configured client ID; only admins may name another team.
+		Team string `json:"team"`
 	}
 
 	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
 		return createErrorResponse(400, "Invalid request format: ", err)
 	}
 
-	// Initialise the AWS client
-	config, err := config.LoadDefaultConfig(ctx, config.WithRegion(req.Region))
+	// A deployment serves its own environment only, so a caller cannot
+	// pick another environment's policy
+	if req.Environment == "" {
+		req.Environment = cfg.Environment
+	}
+	if req.Environment != cfg.Environment {
+		return createErrorResponse(400, "Invalid request format: ", fmt.Errorf("environment must be %q", cfg.Environment))
+	}
+
+	if req.Region != "" && !awsclient.ValidRegion(req.Region) {
+		return createErrorResponse(400, "Invalid request format: ", fmt.Errorf("unknown region %q", req.Region))
+	}
+
+	// The instance is launched in the requested region, while its state
+	// is tracked in the home region
+	ec2Client, err := awsclient.Default().EC2(ctx, req.Region)
+	if err != nil {
+		return createErrorResponse(500, "Failed to initialise AWS config: ", err)
+	}
+
+	// Without a region the instance is launched in the home region. It is
+	// named from here on, so the policy, the cost estimate and the record
+	// all see the region the instance actually runs in.
+	if req.Region == "" {
+		req.Region = ec2Client.Options().Region
+	}
+	dynamoClient, err := awsclient.Default().DynamoDB(ctx, awsclient.HomeRegion)
 	if err != nil {
 		return createErrorResponse(500, "Failed to initialise AWS config: ", err)
 	}
 
 	// Generate unique ID for tracking the instance
 	provisionID := uuid.New().String()
+	ctx = logging.WithField(ctx, logging.ProvisionID, provisionID)
+
+	// Custom tags may not break the EC2 limits or replace the service's
+	// own, and the instance and purchasing options must be ones EC2 accepts
+	violations := validateTags(req.EC2.Tags)
+	violations = append(violations, validateInstanceOptions(req.EC2)...)
+	violations = append(violations, validatePurchasing(req.EC2)...)
+	if len(violations) > 0 {
+		return invalidRequestResponse(ctx, violations)
+	}
 
-	// Create EC2  Client
-	ec2Client := ec2.NewFromConfig(config)
+	// Fill in what the request leaves to its launch template, so policy,
+	// quota and cost see what will actually be launched
+	if err := req.EC2.LaunchTemplate.validate(); err != nil {
+		return createErrorResponse(400, "Invalid launch template: ", err)
+	}
+	resolved, err := resolveLaunchTemplate(ctx, ec2Client, req.EC2)
+	if err != nil {
+		return createErrorResponse(400, "Failed to resolve launch template: ", err)
+	}
+	if resolved.InstanceType == "" {
+		return createErrorResponse(400, "Invalid request format: ", errors.New("instanceType is required"))
+	}
+	if resolved.AMI == "" {
+		return createErrorResponse(400, "Invalid request format: ", errors.New("ami is required"))
+	}
+
+	// Resolve an AMI alias to the image ID of the region, and launch that
+	// very image rather than whatever the alias points to by then
+	amiID, err := resolveAMI(ctx, ec2Client, req.Region, resolved.AMI)
+	if errors.Is(err, errUnresolvedAMI) {
+		return createErrorResponse(400, "Failed to resolve AMI: ", err)
+	}
+	if err != nil {
+		return createErrorResponse(500, "Failed to resolve AMI: ", err)
+	}
+	if amiID != resolved.AMI {
+		logging.Debug(ctx, "Resolved AMI alias", logging.Fields{"ami": resolved.AMI, "image_id": amiID})
+		resolved.AMI = amiID
+		req.EC2.AMI = amiID
+	}
+
+	// The authenticated caller owns the environment
+	owner := cfg.OwnerTag
+	caller, authenticated := auth.FromRequest(event)
+	if authenticated {
+		owner = caller.ID
+		ctx = logging.WithField(ctx, "caller", caller.ID)
+		ctx = logging.WithField(ctx, "caller_name", caller.Name)
+	} else {
+		logging.Warn(ctx, "Unauthenticated provision request, using the default owner", logging.Fields{"owner": owner})
+	}
+
+	// The quota is the deployment's unless an admin books the request on
+	// another team, so a caller cannot pick a team with more headroom
+	team := cfg.ClientID
+	if req.Team != "" && req.Team != team {
+		if !authenticated || !caller.InGroup(cfg.AdminGroups) {
+			return policyViolationResponse(ctx, []policy.Violation{{
+				Field:   "team",
+				Rule:    RuleTeam,
+				Message: fmt.Sprintf("only admins may provision for team %q", req.Team),
+			}})
+		}
+		team = req.Team
+	}
+
+	// Render the user data now, so a bad template is rejected before any
+	// quota is reserved
+	expiresAt := time.Now().Add(time.Duration(req.TTL) * time.Hour)
+	userData, err := renderUserData(req.EC2, bootstrap.Vars{
+		Environment: req.Environment,
+		ProvisionID: provisionID,
+		Region:      req.Region,
+		Owner:       owner,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		return createErrorResponse(400, "Invalid user data: ", err)
+	}
+
+	// Evaluate the request against the policy of its environment
+	violations, err = evaluatePolicy(ctx, cfg, ec2Client, req.Environment, resolved, req.TTL)
+	if err != nil {
+		return createErrorResponse(500, "Failed to evaluate environment policy: ", err)
+	}
+	if len(violations) > 0 {
+		return policyViolationResponse(ctx, violations)
+	}
+
+	// Every volume, including those of the AMI and launch template, is
+	// deleted with the instance
+	blockDevices, err := blockDeviceMappings(ctx, ec2Client, resolved)
+	if err != nil {
+		return createErrorResponse(400, "Failed to resolve block devices: ", err)
+	}
+
+	// Count the request against its team's quota before anything is launched
+	limits := cfg.QuotaFor(team)
+
+	if err := quota.CheckTTL(team, limits, req.TTL); err != nil {
+		return quotaExceededResponse(ctx, err)
+	}
+
+	vcpus, err := quota.VCPUs(ctx, ec2Client, resolved.InstanceType)
+	if err != nil {
+		return createErrorResponse(500, "Failed to look up instance type: ", err)
+	}
+
+	if err := quota.Reserve(ctx, dynamoClient, cfg.TrackingTable, team, limits, vcpus); err != nil {
+		return quotaExceededResponse(ctx, err)
+	}
+
+	// Buffer metrics for this invocation and publish them on the way out
+	recorder := metrics.NewRecorder()
+	defer recorder.Flush(ctx)
+
+	// Estimate the cost over the TTL. Provisioning goes ahead without an
+	// estimate when the price table does not know the instance type. Spot
+	// instances are estimated at the on-demand price, which bounds what
+	// they cost.
+	var estimate *cost.Estimate
+	if e, err := cost.Default().Estimate(req.Region, resolved.InstanceType, 1, float64(req.TTL)); err != nil {
+		logging.Warn(ctx, "No cost estimate for request", logging.Fields{"error": err.Error()})
+	} else {
+		estimate = &e
+	}
+
+	dims := metrics.Dimensions{
+		Environment:  req.Environment,
+		Region:       req.Region,
+		InstanceType: resolved.InstanceType,
+	}
 
 	// Lanuch EC2 instance
-	instanceID, err := lauchEC2Instance(ctx, ec2Client, req.EC2, req.Environment, req.TTL)
+	instanceID, market, err := lauchEC2Instance(ctx, cfg, ec2Client, req.EC2, launchOptions{
+		Tags:         resolved.Tags,
+		UserData:     userData,
+		BlockDevices: blockDevices,
+	}, req.Environment, req.TTL, provisionID, owner)
 	if err != nil {
+		recorder.Failure(metrics.ProvisionFailures, err, dims)
+		dims.Outcome = metrics.OutcomeFailure
+		recorder.Count(metrics.InstancesProvisioned, 1, dims)
+
+		// Nothing was launched, so the reservation is handed back
+		if err := quota.Release(ctx, dynamoClient, cfg.TrackingTable, team, vcpus); err != nil {
+			logging.Error(ctx, "Failed to release quota", err, logging.Fields{"team": team})
+		}
 		return createErrorResponse(500, "Failed to launch EC2 instance: ", err)
 	}
 
-	// Publish provisioning metric after successful launch of EC2 instance
-	metrics.PublishProvisioningMetric(ctx)
+	dims.Outcome = metrics.OutcomeSuccess
+	recorder.Count(metrics.InstancesProvisioned, 1, dims)
+	recorder.Duration(metrics.ProvisionLatency, time.Since(requestedAt), dims)
 
 	// Store the state in DynamoDB
-	if err := storeState(ctx, StateEntry{
-		ID:          provisionID,
-		Environment: req.Environment,
-		Region:      req.Region,
-		InstanceID:  instanceID,
-		Status:      "ACTIVE",
-		CreatedAt:   time.Now(),
-		ExpiresAt:   time.Now().Add(time.Duration(req.TTL) * time.Hour),
-		TTL:         time.Now().Add(time.Duration(req.TTL) * time.Hour).Unix(),
-	}, req.Environment, "provision"); err != nil {
+	entry := StateEntry{
+		ID:           provisionID,
+		Environment:  req.Environment,
+		Region:       req.Region,
+		InstanceID:   instanceID,
+		InstanceType: resolved.InstanceType,
+		Owner:        owner,
+		Team:         team,
+		VCPUs:        vcpus,
+		Status:       StatusActive,
+		CreatedAt:    time.Now(),
+		ExpiresAt:    expiresAt,
+		TTL:          expiresAt.Unix(),
+		Market:       market,
+		ImageID:      resolved.AMI,
+	}
+	if estimate != nil {
+		entry.EstimatedCost = estimate.Total
+		entry.CostCurrency = estimate.Currency
+	}
+	if err := storeState(ctx, dynamoClient, entry, cfg.TrackingTable); err != nil {
+		// Without a record the instance would never be cleaned up, so it
+		// is terminated and its reservation handed back. Should the
+		// termination fail, the drift check finds the instance as an
+		// orphan.
+		if _, err := ec2Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: []string{instanceID},
+		}); err != nil {
+			logging.Error(ctx, "Failed to terminate untracked instance", err, logging.Fields{logging.InstanceID: instanceID})
+		}
+		if err := quota.Release(ctx, dynamoClient, cfg.TrackingTable, team, vcpus); err != nil {
+			logging.Error(ctx, "Failed to release quota", err, logging.Fields{"team": team})
+		}
 		return createErrorResponse(500, "Failed to store state: ", err)
 	}
 
-	// TODO: Corellation logs
-	logging.LogInfo(fmt.Sprintf(
-		"Provision Request: ProvisionID: %s, InstanceID: %s, Environment: %s, Region: %s", provisionID, instanceID, req.Environment, req.Region))
+	// Record the provisioning in the audit trail
+	if err := audit.Record(ctx, cfg.EventsTable, audit.Event{
+		Environment: cfg.Environment,
+		Action:      audit.ActionProvision,
+		Actor:       entry.Owner,
+		ProvisionID: entry.ID,
+		InstanceID:  entry.InstanceID,
+		After: map[string]string{
+			"status":        entry.Status,
+			"instance_type": entry.InstanceType,
+			"region":        entry.Region,
+			"market":        entry.Market,
+			"image_id":      entry.ImageID,
+			"expires_at":    entry.ExpiresAt.Format(time.RFC3339),
+		},
+		Reason: "provision request",
+	}); err != nil {
+		logging.Error(ctx, "Failed to record audit event", err)
+	}
 
-	return events.APIGatewayProxyResponse{
+	// Optionally wait for the instance to reach running to measure it
+	if wait := cfg.WaitForRunning; wait > 0 {
+		if err := ec2.NewInstanceRunningWaiter(ec2Client).Wait(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: []string{instanceID},
+		}, wait); err != nil {
+			logging.Warn(ctx, "Instance did not reach running in time", logging.Fields{
+				logging.InstanceID: instanceID,
+				"wait":             wait.String(),
+				"error":            err.Error(),
+			})
+		} else {
+			recorder.Duration(metrics.TimeToRunning, time.Since(requestedAt), dims)
+		}
+	}
+
+	logging.Info(ctx, "Provisioned environment", logging.Fields{
+		logging.InstanceID:  instanceID,
+		logging.Environment: req.Environment,
+		logging.Region:      req.Region,
+	})
+
+	body, _ := json.Marshal(map[string]any{
+		"success":       true,
+		"provision_id":  provisionID,
+		"instance_id":   instanceID,
+		"market":        market,
+		"image_id":      resolved.AMI,
+		"cost_estimate": estimate,
+	})
+
+	return events.APIGatewayV2HTTPResponse{
 		StatusCode: 200,
-		Body: fmt.Sprintf(`{
-		"success": true, "provision_id": "%s", "instance_id": "%s"}`, provisionID, instanceID),
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
 	}, nil
 
 }
 
-// lauchEC2Instance launches an EC2 instance using the provided EC2 client,
-// configuration, environment, TTL, and custom tags. It returns the instance ID
-// of the newly launched instance, or an error if the launch fails.
-func lauchEC2Instance(ctx context.Context, client *ec2.Client, config EC2Config, env string, ttl int64) (string, error) {
+// requestTime returns when API Gateway received the request, falling
+// back to the current time when the request context does not carry it.
+func requestTime(event events.APIGatewayV2HTTPRequest) time.Time {
+	if epoch := event.RequestContext.TimeEpoch; epoch > 0 {
+		return time.UnixMilli(epoch)
+	}
+	return time.Now()
+}
 
-	provisionID := uuid.New().String()
+// lauchEC2Instance launches an EC2 instance using the provided EC2 client,
+// configuration, environment, TTL, and custom tags. The instance is tagged
+// with the provision ID of the request and its owner. Fields left empty
+// are taken from the launch template, if any. Only IMDSv2 is enabled
+// unless the request allows IMDSv1. It returns the instance ID of the
+// newly launched instance and the market it runs in, or an error if the
+// launch fails. A spot-with-fallback request that finds no spot capacity
+// is launched again on-demand.
+func lauchEC2Instance(ctx context.Context, cfg *appconfig.Config, client *ec2.Client, config EC2Config, opts launchOptions, env string, ttl int64, provisionID string, owner string) (string, string, error) {
 
 	// Parse tags
-	tags := prepareTags(env, ttl, provisionID, config.Tags)
+	tags := prepareTags(cfg, env, ttl, provisionID, owner, opts.Tags)
 
 	// Launch the instance
 	launch := &ec2.RunInstancesInput{
-		ImageId:      aws.String(config.AMI),
-		InstanceType: types.InstanceType(config.InstanceType),
-		KeyName:      aws.String(config.KeyName),
-		SubnetId:     aws.String(config.SubnetID),
+		LaunchTemplate:      config.LaunchTemplate.specification(),
+		SecurityGroupIds:    config.SecurityGroupIDs,
+		IamInstanceProfile:  instanceProfileSpec(config.InstanceProfile),
+		MetadataOptions:     metadataOptions(config.Metadata),
+		BlockDeviceMappings: opts.BlockDevices,
+		// The volumes and network interfaces launched with the instance
+		// carry the same tags
 		TagSpecifications: []types.TagSpecification{
 			{
 				ResourceType: types.ResourceTypeInstance,
 				Tags:         tags,
 			},
+			{
+				ResourceType: types.ResourceTypeVolume,
+				Tags:         tags,
+			},
+			{
+				ResourceType: types.ResourceTypeNetworkInterface,
+				Tags:         tags,
+			},
 		},
 	}
 
+	// Explicit fields override the launch template
+	if config.AMI != "" {
+		launch.ImageId = aws.String(config.AMI)
+	}
+	if config.InstanceType != "" {
+		launch.InstanceType = types.InstanceType(config.InstanceType)
+	}
+	if config.KeyName != "" {
+		launch.KeyName = aws.String(config.KeyName)
+	}
+	if config.SubnetID != "" {
+		launch.SubnetId = aws.String(config.SubnetID)
+	}
+	if opts.UserData != "" {
+		launch.UserData = aws.String(opts.UserData)
+	}
+
+	if config.wantsSpot() {
+		launch.InstanceMarketOptions = spotMarketOptions(config.MaxPrice)
+	}
+
 	result, err := client.RunInstances(ctx, launch)
+	if err != nil && config.Purchasing == PurchasingSpotWithFallback && isSpotCapacityError(err) {
+		logging.Warn(ctx, "No spot capacity, launching on-demand", logging.Fields{"error": err.Error()})
+		launch.InstanceMarketOptions = nil
+		result, err = client.RunInstances(ctx, launch)
+	}
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	return *result.Instances[0].InstanceId, nil
+	// The launch template may ask for spot capacity itself, so the market
+	// is taken from the launched instance
+	instance := result.Instances[0]
+	market := MarketOnDemand
+	if instance.InstanceLifecycle == types.InstanceLifecycleTypeSpot {
+		market = MarketSpot
+	}
+
+	return *instance.InstanceId, market, nil
 }
 
 // prepareTags constructs a list of EC2 instance tags based on the provided
-// environment, TTL, provision ID, and custom tags. It includes default tags
-// such as Environment, ExpiresAt (calculated using the TTL), ProvisionID,
-// Service, and Owner. The function then appends any additional custom tags
-// provided in the customTags map. Returns a slice of types.Tag to be applied
-// to the EC2 instance.
-func prepareTags(env string, ttl int64, provisionID string, customTags map[string]string) []types.Tag {
+// environment, TTL, provision ID, owner and custom tags. It includes default
+// tags such as Environment, ExpiresAt (calculated using the TTL), ProvisionID,
+// Service, whose value comes from the service configuration, and Owner. The
+// function then appends any additional custom tags provided in the customTags
+// map, which validateTags has checked for reserved keys. Returns a slice of
+// types.Tag to be applied to the EC2 instance and its volumes and network
+// interfaces.
+func prepareTags(cfg *appconfig.Config, env string, ttl int64, provisionID string, owner string, customTags map[string]string) []types.Tag {
 
 	tags := []types.Tag{
 		{
@@ -154,8 +556,8 @@ func prepareTags(env string, ttl int64, provisionID string, customTags map[strin
 			Value: aws.String(time.Now().Add(time.Duration(ttl) * time.Hour).Format(time.RFC3339)),
 		},
 		{Key: aws.String("ProvisionID"), Value: aws.String(provisionID)}, // Unique identifier tag
-		{Key: aws.String("Service"), Value: aws.String("DynamicProvisioning")},
-		{Key: aws.String("Owner"), Value: aws.String("AutomationLambda")},
+		{Key: aws.String("Service"), Value: aws.String(cfg.ServiceTag)},
+		{Key: aws.String("Owner"), Value: aws.String(owner)},
 	}
 
 	// Add custom tags
@@ -172,34 +574,68 @@ func prepareTags(env string, ttl int64, provisionID string, customTags map[strin
 // createErrorResponse constructs an API Gateway Proxy response with the given
 // HTTP status code, error message, and error details. It returns a formatted
 // response including a JSON body that indicates the failure, along with the
-// original error. The response headers specify JSON content type.
-func createErrorResponse(statusCode int, message string, err error) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{
+// original error. The response headers specify JSON content type. The error
+// text is redacted before it is put in the body or returned, since both end
+// up with the caller or in the Lambda logs.
+func createErrorResponse(statusCode int, message string, err error) (events.APIGatewayV2HTTPResponse, error) {
+	detail := ""
+	if err != nil {
+		detail = redact.Default().String(err.Error())
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"success": false,
+		"message": message,
+		"error":   detail,
+	})
+
+	return events.APIGatewayV2HTTPResponse{
 		StatusCode: statusCode,
-		Body:       fmt.Sprintf(`{"success": false, "message": "%s", "error": "%v"}`, message, err),
+		Body:       string(body),
 		Headers: map[string]string{
 			"Content-Type": "application/json",
 		},
-	}, fmt.Errorf("%s: %v", message, err)
+	}, fmt.Errorf("%s: %s", message, detail)
 }
 
-// storeState stores the given StateEntry in DynamoDB. It uses the AWS default
-// configuration for the current context. The StateEntry is marshaled to a map
-// using the attributevalue package. The item is then put into the DynamoDB table.
-func storeState(ctx context.Context, entry StateEntry, environment string, tableType string) error {
-	// Create a DynamoDB client
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to load AWS config: %s", err)
+// quotaExceededResponse returns a 429 response naming the limit the
+// request hit. Errors other than a quota.ExceededError become a 500. The
+// Lambda error is nil, so that API Gateway passes the status code on.
+func quotaExceededResponse(ctx context.Context, err error) (events.APIGatewayV2HTTPResponse, error) {
+	var exceeded *quota.ExceededError
+	if !errors.As(err, &exceeded) {
+		return createErrorResponse(500, "Failed to reserve quota: ", err)
 	}
 
-	tableName, err := ssm.TableName(environment, tableType)
-	if err != nil {
-		return fmt.Errorf("failed to get table name: %w", err)
-	}
+	logging.Warn(ctx, "Quota exceeded", logging.Fields{
+		"team":      exceeded.Team,
+		"limit":     exceeded.Limit,
+		"max":       exceeded.Max,
+		"current":   exceeded.Current,
+		"requested": exceeded.Requested,
+	})
 
-	dynamoClient := dynamodb.NewFromConfig(cfg)
+	body, _ := json.Marshal(map[string]any{
+		"success": false,
+		"message": "Quota exceeded",
+		"error":   exceeded.Error(),
+		"quota":   exceeded,
+	})
 
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 429,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}, nil
+}
+
+// storeState stores the given StateEntry in DynamoDB through the given
+// client, which targets the region of the tracking table. The StateEntry
+// is marshaled to a map using the attributevalue package. The item is then
+// put into the DynamoDB table.
+func storeState(ctx context.Context, dynamoClient *dynamodb.Client, entry StateEntry, tableName string) error {
 	// Marshal the StateEntry struct to a map
 	item, err := attributevalue.MarshalMap(entry)
 	if err != nil {
@@ -218,19 +654,43 @@ func storeState(ctx context.Context, entry StateEntry, environment string, table
 	return nil
 }
 
+// LoadState returns the StateEntry with the given provision ID, or nil
+// when the tracking table has no such record
+func LoadState(ctx context.Context, dynamoClient *dynamodb.Client, provisionID string, tableName string) (*StateEntry, error) {
+	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"ID": &dynamodbTypes.AttributeValueMemberS{Value: provisionID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get item from DynamoDB: %w", err)
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+
+	var entry StateEntry
+	if err := attributevalue.UnmarshalMap(result.Item, &entry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal state entry: %w", err)
+	}
+
+	return &entry, nil
+}
+
 // storeStateWithRetries stores the given StateEntry in DynamoDB and retries up to maxEntries times
 // if it fails. If all retries fail, it returns an error.
-func storeStateWithRetries(ctx context.Context, entry StateEntry, maxEntries int, environment string, tableType string) error {
+func storeStateWithRetries(ctx context.Context, dynamoClient *dynamodb.Client, entry StateEntry, maxEntries int, tableName string) error {
 
 	for i := 0; i < maxEntries; i++ {
-		err := storeState(ctx, entry, environment, tableType)
+		err := storeState(ctx, dynamoClient, entry, tableName)
 		if err != nil {
-			logging.LogInfo(fmt.Sprintf("Successfully stored state in DynamoDB for InstanceID: %s, provisionID: %s", entry.InstanceID, entry.ID))
+			logging.Info(ctx, "Successfully stored state in DynamoDB", logging.Fields{logging.InstanceID: entry.InstanceID, logging.ProvisionID: entry.ID})
 
 			return nil
 		}
 
-		logging.LogError(fmt.Sprintf("Failed to store state for ProvisionID: %s (attempt: %d/%d): %v", entry.ID, i+1, maxEntries, err), err)
+		logging.Error(ctx, "Failed to store state", err, logging.Fields{logging.ProvisionID: entry.ID, "attempt": i + 1, "max_attempts": maxEntries})
 		time.Sleep(time.Duration(i+1) * time.Second)
 	}
 
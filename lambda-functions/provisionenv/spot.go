@@ -0,0 +1,105 @@
+package provisionenv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/policy"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/smithy-go"
+)
+
+// Purchasing options of a provision request
+const (
+	PurchasingOnDemand         = "on-demand"
+	PurchasingSpot             = "spot"
+	PurchasingSpotWithFallback = "spot-with-fallback"
+)
+
+// Markets an instance runs in, as recorded on its StateEntry. Records
+// written before spot support have no market and ran on-demand.
+const (
+	MarketOnDemand = "on-demand"
+	MarketSpot     = "spot"
+)
+
+// RulePurchasing is reported for an invalid purchasing option
+const RulePurchasing = "purchasing"
+
+// spotCapacityCodes are the RunInstances error codes after which a
+// spot-with-fallback request is retried on-demand
+var spotCapacityCodes = map[string]bool{
+	"InsufficientInstanceCapacity": true,
+	"SpotMaxPriceTooLow":           true,
+	"MaxSpotInstanceCountExceeded": true,
+	"SpotCapacityNotAvailable":     true,
+}
+
+// validatePurchasing checks the purchasing option and maximum price of a
+// request
+func validatePurchasing(config EC2Config) []policy.Violation {
+	var violations []policy.Violation
+
+	switch config.Purchasing {
+	case "", PurchasingOnDemand:
+		if config.MaxPrice != "" {
+			violations = append(violations, policy.Violation{
+				Field:   "ec2.max_price",
+				Rule:    RulePurchasing,
+				Message: "max_price only applies to spot purchasing",
+			})
+		}
+		return violations
+	case PurchasingSpot, PurchasingSpotWithFallback:
+	default:
+		return append(violations, policy.Violation{
+			Field:   "ec2.purchasing",
+			Rule:    RulePurchasing,
+			Message: fmt.Sprintf("purchasing must be %s, %s or %s", PurchasingOnDemand, PurchasingSpot, PurchasingSpotWithFallback),
+		})
+	}
+
+	if config.MaxPrice != "" {
+		if price, err := strconv.ParseFloat(config.MaxPrice, 64); err != nil || price <= 0 {
+			violations = append(violations, policy.Violation{
+				Field:   "ec2.max_price",
+				Rule:    RulePurchasing,
+				Message: fmt.Sprintf("max_price must be a positive hourly price, got %q", config.MaxPrice),
+			})
+		}
+	}
+
+	return violations
+}
+
+// wantsSpot reports whether the request asks for spot capacity
+func (c EC2Config) wantsSpot() bool {
+	return c.Purchasing == PurchasingSpot || c.Purchasing == PurchasingSpotWithFallback
+}
+
+// spotMarketOptions returns the market options of a one-time spot
+// request. An interrupted instance is terminated rather than stopped, as
+// the environment is torn down when that happens. Without a maximum
+// price EC2 caps it at the on-demand price.
+func spotMarketOptions(maxPrice string) *types.InstanceMarketOptionsRequest {
+	options := &types.InstanceMarketOptionsRequest{
+		MarketType: types.MarketTypeSpot,
+		SpotOptions: &types.SpotMarketOptions{
+			SpotInstanceType:             types.SpotInstanceTypeOneTime,
+			InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorTerminate,
+		},
+	}
+	if maxPrice != "" {
+		options.SpotOptions.MaxPrice = aws.String(maxPrice)
+	}
+	return options
+}
+
+// isSpotCapacityError reports whether err means no spot capacity was
+// available at the requested price
+func isSpotCapacityError(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && spotCapacityCodes[apiErr.ErrorCode()]
+}
@@ -0,0 +1,109 @@
+package provisionenv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/30Piraten/aws-dynamicEventBuilder/policy"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// EC2 tag limits
+const (
+	maxTagsPerResource = 50
+	maxTagKeyLength    = 128
+	maxTagValueLength  = 256
+)
+
+// ReservedTagKeys are set by the service on every instance. Cleanup,
+// drift detection and ownership rely on them, so callers may not send
+// them as custom tags.
+var ReservedTagKeys = []string{"Environment", "ExpiresAt", "ProvisionID", "Service", "Owner"}
+
+// Rules reported for invalid custom tags
+const (
+	RuleTagCount    = "max_tags"
+	RuleTagKey      = "tag_key"
+	RuleTagValue    = "tag_value"
+	RuleReservedTag = "reserved_tag"
+)
+
+// validateTags checks the custom tags of a request against the EC2 limits
+// and the reserved keys, and returns every problem found. The count
+// includes the tags the service adds itself.
+func validateTags(customTags map[string]string) []policy.Violation {
+	var violations []policy.Violation
+
+	if total := len(customTags) + len(ReservedTagKeys); total > maxTagsPerResource {
+		violations = append(violations, policy.Violation{
+			Field:   "ec2.tags",
+			Rule:    RuleTagCount,
+			Message: fmt.Sprintf("at most %d custom tags are allowed, got %d", maxTagsPerResource-len(ReservedTagKeys), len(customTags)),
+		})
+	}
+
+	// Sorted, so the violations come back in a stable order
+	keys := make([]string, 0, len(customTags))
+	for k := range customTags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		field := "ec2.tags." + key
+
+		switch {
+		case strings.TrimSpace(key) == "":
+			violations = append(violations, policy.Violation{Field: field, Rule: RuleTagKey, Message: "tag key must not be empty"})
+		case utf8.RuneCountInString(key) > maxTagKeyLength:
+			violations = append(violations, policy.Violation{Field: field, Rule: RuleTagKey, Message: fmt.Sprintf("tag key is longer than %d characters", maxTagKeyLength)})
+		case strings.HasPrefix(strings.ToLower(key), "aws:"):
+			violations = append(violations, policy.Violation{Field: field, Rule: RuleTagKey, Message: "tag keys starting with aws: are reserved by AWS"})
+		case isReservedTag(key):
+			violations = append(violations, policy.Violation{Field: field, Rule: RuleReservedTag, Message: fmt.Sprintf("tag %q is set by the service", key)})
+		}
+
+		if utf8.RuneCountInString(customTags[key]) > maxTagValueLength {
+			violations = append(violations, policy.Violation{Field: field, Rule: RuleTagValue, Message: fmt.Sprintf("tag value is longer than %d characters", maxTagValueLength)})
+		}
+	}
+
+	return violations
+}
+
+// isReservedTag reports whether key is a reserved key, ignoring case so
+// that "owner" cannot pass for "Owner" in case-insensitive tooling
+func isReservedTag(key string) bool {
+	for _, reserved := range ReservedTagKeys {
+		if strings.EqualFold(key, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidRequestResponse returns a 400 response listing every problem
+// with the tags and instance options of the request. The Lambda error is
+// nil, so that API Gateway passes the status code on.
+func invalidRequestResponse(ctx context.Context, violations []policy.Violation) (events.APIGatewayV2HTTPResponse, error) {
+	logging.Warn(ctx, "Request has invalid EC2 options", logging.Fields{"violations": violations})
+
+	body, _ := json.Marshal(map[string]any{
+		"success":    false,
+		"message":    "Invalid EC2 options",
+		"violations": violations,
+	})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 400,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}, nil
+}
@@ -0,0 +1,54 @@
+package provisionenv
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateTags(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := 0; i < maxTagsPerResource-len(ReservedTagKeys)+1; i++ {
+		tooMany[fmt.Sprintf("tag%02d", i)] = "value"
+	}
+	atLimit := make(map[string]string)
+	for i := 0; i < maxTagsPerResource-len(ReservedTagKeys); i++ {
+		atLimit[fmt.Sprintf("tag%02d", i)] = "value"
+	}
+
+	tests := []struct {
+		name string
+		tags map[string]string
+		want []string
+	}{
+		{name: "no tags"},
+		{name: "valid tags", tags: map[string]string{"Project": "builder", "CostCenter": "42"}},
+		{name: "at the tag limit", tags: atLimit},
+		{name: "over the tag limit", tags: tooMany, want: []string{RuleTagCount}},
+		{name: "empty key", tags: map[string]string{" ": "value"}, want: []string{RuleTagKey}},
+		{name: "long key", tags: map[string]string{strings.Repeat("k", maxTagKeyLength+1): "value"}, want: []string{RuleTagKey}},
+		{name: "aws prefix", tags: map[string]string{"AWS:cloudformation": "value"}, want: []string{RuleTagKey}},
+		{name: "reserved key", tags: map[string]string{"Owner": "someone"}, want: []string{RuleReservedTag}},
+		{name: "reserved key in another case", tags: map[string]string{"expiresat": "never"}, want: []string{RuleReservedTag}},
+		{name: "long value", tags: map[string]string{"Project": strings.Repeat("v", maxTagValueLength+1)}, want: []string{RuleTagValue}},
+		{name: "value at the limit counts runes", tags: map[string]string{"Project": strings.Repeat("é", maxTagValueLength)}},
+		{
+			name: "every problem is reported in key order",
+			tags: map[string]string{"Service": strings.Repeat("v", maxTagValueLength+1), "aws:x": "y"},
+			want: []string{RuleReservedTag, RuleTagValue, RuleTagKey},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range validateTags(tt.tags) {
+				got = append(got, v.Rule)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateTags() rules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package provisionenv
+
+import (
+	"errors"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/bootstrap"
+)
+
+// Bootstrap names the bootstrap template an instance is configured with
+// and the parameters it is rendered with
+type Bootstrap struct {
+	Template string            `json:"template"`
+	Params   map[string]string `json:"params,omitempty"`
+}
+
+// renderUserData returns the base64 encoded user data of the request, or
+// an empty string when it has none. The script is never logged, as it
+// may carry credentials passed as parameters.
+func renderUserData(config EC2Config, vars bootstrap.Vars) (string, error) {
+	if config.UserData != "" && config.Bootstrap != nil {
+		return "", errors.New("only one of user_data and bootstrap may be set")
+	}
+
+	script := config.UserData
+	if b := config.Bootstrap; b != nil {
+		if b.Template == "" {
+			return "", errors.New("bootstrap template is required")
+		}
+
+		vars.Params = b.Params
+		rendered, err := bootstrap.Default().Render(b.Template, vars)
+		if err != nil {
+			return "", err
+		}
+		script = rendered
+	}
+
+	if script == "" {
+		return "", nil
+	}
+	if err := bootstrap.CheckSize(script); err != nil {
+		return "", err
+	}
+
+	return bootstrap.Encode(script), nil
+}
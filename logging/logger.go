@@ -1,32 +1,121 @@
 package logging
 
 import (
-	"os"
+	"context"
+	"strings"
 
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/sirupsen/logrus"
 )
 
 var logger = logrus.New()
 
-func Init() {
-	// Set log format to JSON for structured logging
-	logger.SetFormatter(&logrus.JSONFormatter{
-		PrettyPrint: true,
-	})
+// Fields are structured key/value pairs attached to a log entry
+type Fields map[string]any
+
+// Correlation field names attached to log entries through the context
+const (
+	LambdaRequestID = "lambda_request_id"
+	APIRequestID    = "api_request_id"
+	ProvisionID     = "provision_id"
+)
+
+// Common field names
+const (
+	InstanceID  = "instance_id"
+	Environment = "environment"
+	Region      = "region"
+	Status      = "status"
+)
+
+// Output formats selected with LOG_FORMAT
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// fieldsKey is the context key the correlation fields are stored under
+type fieldsKey struct{}
+
+// Init configures the logger. format selects compact JSON (the default)
+// or human-readable text, and level one of debug, info (the default),
+// warn or error.
+func Init(level string, format string) {
+	// One JSON object per line so that CloudWatch keeps entries whole
+	if strings.ToLower(format) == FormatText {
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	} else {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	}
 
-	// Set log level (info for production, debug for development)
 	logger.SetLevel(logrus.InfoLevel)
-	if os.Getenv("DEBUG") == "true" {
-		logger.SetLevel(logrus.DebugLevel)
+	if parsed, err := logrus.ParseLevel(level); err == nil {
+		logger.SetLevel(parsed)
+	}
+}
+
+// WithField returns a copy of ctx that attaches key=value to every
+// entry logged with it. Empty values are ignored.
+func WithField(ctx context.Context, key string, value string) context.Context {
+	if value == "" {
+		return ctx
+	}
+
+	current, _ := ctx.Value(fieldsKey{}).(logrus.Fields)
+	fields := make(logrus.Fields, len(current)+1)
+	for k, v := range current {
+		fields[k] = v
 	}
+	fields[key] = value
+
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+// WithLambdaRequest returns a copy of ctx carrying the Lambda request ID
+// of the current invocation, when there is one.
+func WithLambdaRequest(ctx context.Context) context.Context {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return WithField(ctx, LambdaRequestID, lc.AwsRequestID)
+	}
+	return ctx
+}
+
+// entry returns a log entry carrying the correlation fields of ctx
+// and the given fields
+func entry(ctx context.Context, fields []Fields) *logrus.Entry {
+	e := logrus.NewEntry(logger)
+	if ctx != nil {
+		if correlation, ok := ctx.Value(fieldsKey{}).(logrus.Fields); ok {
+			e = e.WithFields(correlation)
+		}
+	}
+
+	for _, f := range fields {
+		e = e.WithFields(logrus.Fields(f))
+	}
+	return e
+}
+
+// Debug logs msg at debug level
+func Debug(ctx context.Context, msg string, fields ...Fields) {
+	entry(ctx, fields).Debug(msg)
 }
 
-func LogError(msg string, err error) {
-	logger.WithFields(logrus.Fields{
-		"error": err.Error(),
-	}).Error(msg)
+// Info logs msg at info level
+func Info(ctx context.Context, msg string, fields ...Fields) {
+	entry(ctx, fields).Info(msg)
 }
 
-func LogInfo(msg string) {
-	logger.Info(msg)
+// Warn logs msg at warn level
+func Warn(ctx context.Context, msg string, fields ...Fields) {
+	entry(ctx, fields).Warn(msg)
+}
+
+// Error logs msg at error level with err in the error field
+func Error(ctx context.Context, msg string, err error, fields ...Fields) {
+	e := entry(ctx, fields)
+	if err != nil {
+		e = e.WithField("error", err.Error())
+	}
+	e.Error(msg)
 }
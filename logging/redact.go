@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"github.com/30Piraten/aws-dynamicEventBuilder/redact"
+	"github.com/sirupsen/logrus"
+)
+
+// redactHook masks sensitive fields and patterns in every entry before
+// it is formatted, with the Redactor configured at the time
+type redactHook struct{}
+
+func init() {
+	logger.AddHook(redactHook{})
+}
+
+// Levels applies the hook to every level
+func (h redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire masks the message and the field values of the entry
+func (h redactHook) Fire(e *logrus.Entry) error {
+	redactor := redact.Default()
+	e.Message = redactor.String(e.Message)
+
+	// Entries share their Data with the entry they were derived from,
+	// so the masked values go into a copy
+	data := make(logrus.Fields, len(e.Data))
+	for k, v := range e.Data {
+		data[k] = redactor.Field(k, v)
+	}
+	e.Data = data
+
+	return nil
+}
@@ -1,12 +1,51 @@
 package main
 
 import (
-	// cleanup "github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/cleanupenv"
+	"context"
+	"log"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/audit"
+	"github.com/30Piraten/aws-dynamicEventBuilder/inventory"
+	cleanup "github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/cleanupenv"
+	lifecycle "github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/lifecycleenv"
 	proenv "github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/30Piraten/aws-dynamicEventBuilder/metrics"
+	"github.com/30Piraten/aws-dynamicEventBuilder/monitordrift"
+	"github.com/30Piraten/aws-dynamicEventBuilder/server"
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 func main() {
-	// lambda.Start(cleanup.HandleCleanupRequest)
-	lambda.Start(proenv.HandleProvisionRequest)
+	// Load and validate the configuration once, at cold start
+	cfg, err := appconfig.Load(context.Background())
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+
+	logging.Init(cfg.LogLevel, cfg.LogFormat)
+	metrics.Configure(cfg.MetricsMode, cfg.MetricsNamespace)
+
+	// Run as a long-lived local server instead of a Lambda function
+	if cfg.LocalAddr != "" {
+		log.Fatal(server.ListenAndServe(cfg))
+	}
+
+	switch cfg.Handler {
+	case appconfig.HandlerCleanup:
+		lambda.Start(cleanup.NewCleanupHandler(cfg))
+	case appconfig.HandlerDrift:
+		lambda.Start(monitordrift.NewDriftHandler(cfg))
+	case appconfig.HandlerInventory:
+		lambda.Start(inventory.NewInventoryHandler(cfg))
+	case appconfig.HandlerHistory:
+		lambda.Start(audit.NewHistoryHandler(cfg))
+	case appconfig.HandlerLifecycle:
+		lambda.Start(lifecycle.NewLifecycleHandler(cfg))
+	case appconfig.HandlerSpotInterruption:
+		lambda.Start(lifecycle.NewInterruptionHandler(cfg))
+	default:
+		lambda.Start(proenv.NewProvisionHandler(cfg))
+	}
 }
@@ -2,6 +2,7 @@ module "events" {
   source      = "./modules/events"
   environment = var.environment
   cleanup_lambda_arn  = module.lambda.aws_cleanup_lambda_arn
+  spot_interruption_lambda_arn = module.lambda.aws_spot_interruption_lambda_arn
   client_id = var.client_id
 }
 
@@ -9,6 +10,9 @@ module "events" {
 #   source = "./modules/monitordrift"
 #   monitor_drift_lambda_role = module.lambda.aws_iam_role_lambda_exec_arn
 #   region = var.region
+#   environment_tag = var.environment
+#   table_name = module.dynamodb.aws_dynamodb_table.name
+#   client_id = var.client_id
 # }
 
 module "ssm" {
@@ -16,14 +20,23 @@ module "ssm" {
   environment = var.environment
   table-type = var.table-type
   dynamodb_table_name = module.dynamodb.aws_dynamodb_table.name
+  dynamodb_events_table_name = module.dynamodb.aws_dynamodb_events_table.name
+  provision_policy = var.provision_policy
 }
 
 module "lambda" {
   source          = "./modules/lambda"
   environment_tag = var.environment
   table_name      = module.dynamodb.aws_dynamodb_table.name
+  table_arn       = module.dynamodb.aws_dynamodb_table.arn
+  events_table_arn = module.dynamodb.aws_dynamodb_events_table.arn
+  client_id       = var.client_id
   terraform_dir   = var.terraform_dir
   source_arn = module.events.environement_cleanup
+  spot_interruption_source_arn = module.events.spot_interruption
+  jwt_issuer      = var.jwt_issuer
+  jwt_audience    = var.jwt_audience
+  instance_profile_role_arns = var.instance_profile_role_arns
 }
 
 module "api_gateway" {
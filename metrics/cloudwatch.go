@@ -4,74 +4,52 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
 	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 )
 
-// TODO: MAKE USE OF DRY
+// maxDatumsPerRequest is the PutMetricData limit on datums per call
+const maxDatumsPerRequest = 1000
 
-// PublishProvisioningMetric publishes a custom metric for
-// instance provisioning.
-func PublishProvisioningMetric(ctx context.Context) {
+// CloudWatchSink publishes datums through the PutMetricData API
+type CloudWatchSink struct{}
 
-	cfg, err := config.LoadDefaultConfig(ctx)
+// Publish sends the datums to CloudWatch in as few calls as possible
+func (CloudWatchSink) Publish(ctx context.Context, datums []Datum) error {
+	client, err := awsclient.Default().CloudWatch(ctx, awsclient.HomeRegion)
 	if err != nil {
-		logging.LogError("Failed to load AWS config:", fmt.Errorf("%s", err))
+		return fmt.Errorf("failed to create CloudWatch client: %w", err)
 	}
 
-	// Initialise CloudWatch client
-	cloudWatchClient := cloudwatch.NewFromConfig(cfg)
-
-	_, ok := cloudWatchClient.PutMetricData(context.TODO(), &cloudwatch.PutMetricDataInput{
-		Namespace: aws.String("EC2ProvisionMetrics"),
-		MetricData: []types.MetricDatum{
-			{
-				MetricName: aws.String("InstancesProvisioned"),
-				Unit:       types.StandardUnitCount,
-
-				// Allows the increment of provisioning by 1
-				Value: aws.Float64(1),
-			},
-		},
-	})
-
-	if ok != nil {
-		logging.LogError("Failed to publish provisioning metric: ", ok)
-	} else {
-		logging.LogInfo("Published provisioning metric to CloudWatch")
+	metricData := make([]types.MetricDatum, 0, len(datums))
+	for _, d := range datums {
+		var dims []types.Dimension
+		for _, dim := range d.Dimensions.list() {
+			dims = append(dims, types.Dimension{Name: aws.String(dim.Name), Value: aws.String(dim.Value)})
+		}
+
+		metricData = append(metricData, types.MetricDatum{
+			MetricName: aws.String(d.Name),
+			Unit:       d.Unit,
+			Value:      aws.Float64(d.Value),
+			Dimensions: dims,
+		})
 	}
-}
 
-// PublishTerminationMetric publishes a custom metric for instance termination
-func PublishTerminationMetric(ctx context.Context) {
+	for start := 0; start < len(metricData); start += maxDatumsPerRequest {
+		end := min(start+maxDatumsPerRequest, len(metricData))
 
-	config, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		logging.LogError("Failed to load AWS config:", fmt.Errorf("%s", err))
+		if _, err := client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(Namespace()),
+			MetricData: metricData[start:end],
+		}); err != nil {
+			return fmt.Errorf("failed to publish metrics to CloudWatch: %w", err)
+		}
 	}
 
-	// Initialise CloudWatch client
-	cloudWatchClient := cloudwatch.NewFromConfig(config)
-
-	_, ok := cloudWatchClient.PutMetricData(context.TODO(), &cloudwatch.PutMetricDataInput{
-		Namespace: aws.String("EC2ProvisioningMetrics"),
-		MetricData: []types.MetricDatum{
-			{
-				MetricName: aws.String("InstancesTerminated"),
-				Unit:       types.StandardUnitCount,
-
-				// Every termination increases by 1
-				Value: aws.Float64(1),
-			},
-		},
-	})
-
-	if ok != nil {
-		logging.LogError("Failed to publish termination metric: ", ok)
-	} else {
-		logging.LogInfo("Published termination metric to CloudWatch")
-	}
+	logging.Debug(ctx, "Published metrics to CloudWatch", logging.Fields{"datums": len(metricData)})
+	return nil
 }
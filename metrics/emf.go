@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EMFSink writes datums as Embedded Metric Format log lines, which
+// CloudWatch Logs extracts into metrics without an API call
+type EMFSink struct {
+	Writer io.Writer
+}
+
+// emfMetric is a metric definition inside an EMF directive
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// emfDirective tells CloudWatch which members of the log line are metrics
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+// emfMetadata is the _aws member of an EMF log line
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// Publish writes one EMF log line per datum
+func (s EMFSink) Publish(_ context.Context, datums []Datum) error {
+	timestamp := time.Now().UnixMilli()
+
+	for _, d := range datums {
+		line := map[string]any{}
+
+		dimNames := []string{}
+		for _, dim := range d.Dimensions.list() {
+			line[dim.Name] = dim.Value
+			dimNames = append(dimNames, dim.Name)
+		}
+
+		line[d.Name] = d.Value
+		line["_aws"] = emfMetadata{
+			Timestamp: timestamp,
+			CloudWatchMetrics: []emfDirective{
+				{
+					Namespace:  Namespace(),
+					Dimensions: [][]string{dimNames},
+					Metrics:    []emfMetric{{Name: d.Name, Unit: string(d.Unit)}},
+				},
+			},
+		}
+
+		encoded, err := json.Marshal(line)
+		if err != nil {
+			return fmt.Errorf("failed to encode EMF metric %s: %w", d.Name, err)
+		}
+
+		if _, err := fmt.Fprintln(s.Writer, string(encoded)); err != nil {
+			return fmt.Errorf("failed to write EMF metric %s: %w", d.Name, err)
+		}
+	}
+
+	return nil
+}
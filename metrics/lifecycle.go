@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/smithy-go"
+)
+
+// Lifecycle latency metrics. CloudWatch computes percentiles
+// (p50, p90, p99) over the individual datums.
+const (
+	// ProvisionLatency is the time from the provision request to
+	// RunInstances succeeding
+	ProvisionLatency = "ProvisionLatency"
+
+	// TimeToRunning is the time from the provision request to the
+	// instance reaching the running state
+	TimeToRunning = "TimeToRunning"
+
+	// ExpiryToTermination is the time from an environment expiring to
+	// its termination being accepted by EC2
+	ExpiryToTermination = "ExpiryToTermination"
+)
+
+// Failure counters, dimensioned by ErrorCode
+const (
+	ProvisionFailures   = "ProvisionFailures"
+	TerminationFailures = "TerminationFailures"
+)
+
+// ErrorCode dimension values for errors that are not AWS API errors
+// or that are grouped together
+const (
+	ErrorCodeThrottling = "Throttling"
+	ErrorCodeUnknown    = "Unknown"
+)
+
+// throttlingCodes are the AWS error codes that mean the request was throttled
+var throttlingCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestLimitExceeded":                   true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"SlowDown":                               true,
+}
+
+// ErrorCode classifies err by its AWS error code, such as
+// InsufficientInstanceCapacity or UnauthorizedOperation. Every
+// throttling code is reported as Throttling.
+func ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() == "" {
+		return ErrorCodeUnknown
+	}
+
+	if throttlingCodes[apiErr.ErrorCode()] {
+		return ErrorCodeThrottling
+	}
+
+	return apiErr.ErrorCode()
+}
+
+// Duration buffers d in milliseconds
+func (r *Recorder) Duration(name string, d time.Duration, dims Dimensions) {
+	r.Record(name, float64(d.Milliseconds()), types.StandardUnitMilliseconds, dims)
+}
+
+// Failure counts one failure of err under the given metric name
+func (r *Recorder) Failure(name string, err error, dims Dimensions) {
+	dims.Outcome = OutcomeFailure
+	dims.ErrorCode = ErrorCode(err)
+	r.Count(name, 1, dims)
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestErrorCode(t *testing.T) {
+	apiError := func(code string) error {
+		return &smithy.GenericAPIError{Code: code, Message: "message"}
+	}
+
+	cases := map[error]string{
+		errors.New("boom"):                       ErrorCodeUnknown,
+		apiError(""):                             ErrorCodeUnknown,
+		apiError("InsufficientInstanceCapacity"): "InsufficientInstanceCapacity",
+		fmt.Errorf("launch: %w", apiError("UnauthorizedOperation")): "UnauthorizedOperation",
+		apiError("RequestLimitExceeded"):                            ErrorCodeThrottling,
+		apiError("ProvisionedThroughputExceededException"):          ErrorCodeThrottling,
+	}
+	for err, want := range cases {
+		if got := ErrorCode(err); got != want {
+			t.Errorf("ErrorCode(%v) = %q, want %q", err, got, want)
+		}
+	}
+
+	if got := ErrorCode(nil); got != ErrorCodeUnknown {
+		t.Errorf("ErrorCode(nil) = %q, want %q", got, ErrorCodeUnknown)
+	}
+}
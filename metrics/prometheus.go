@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// defaultPrometheus is the process-wide sink used when METRICS_MODE
+// is prometheus
+var defaultPrometheus = NewPrometheusSink()
+
+// PrometheusHandler serves the process-wide Prometheus sink
+func PrometheusHandler() http.Handler {
+	return defaultPrometheus
+}
+
+// series is the accumulated state of one metric and label set
+type series struct {
+	name   string
+	kind   Kind
+	labels string
+	value  float64
+	count  int
+}
+
+// PrometheusSink accumulates datums in process and serves them in the
+// Prometheus text exposition format. Counters are summed, gauges keep
+// their latest value and distributions are exposed as a _sum and _count.
+type PrometheusSink struct {
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// NewPrometheusSink returns an empty PrometheusSink
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{series: make(map[string]*series)}
+}
+
+// Publish folds the datums into the accumulated series
+func (p *PrometheusSink) Publish(_ context.Context, datums []Datum) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, d := range datums {
+		name := prometheusName(d)
+		labels := prometheusLabels(d.Dimensions)
+		key := name + labels
+
+		s, ok := p.series[key]
+		if !ok {
+			s = &series{name: name, kind: d.Kind, labels: labels}
+			p.series[key] = s
+		}
+
+		switch d.Kind {
+		case KindGauge:
+			s.value = d.Value
+		default:
+			s.value += d.Value
+			s.count++
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP writes every series in the text exposition format
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	p.mu.Lock()
+	all := make([]*series, 0, len(p.series))
+	for _, s := range p.series {
+		copied := *s
+		all = append(all, &copied)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		return all[i].labels < all[j].labels
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	lastName := ""
+	for _, s := range all {
+		if s.name != lastName {
+			fmt.Fprintf(w, "# TYPE %s %s\n", s.name, prometheusType(s.kind))
+			lastName = s.name
+		}
+
+		if s.kind == KindDistribution {
+			fmt.Fprintf(w, "%s_sum%s %g\n", s.name, s.labels, s.value)
+			fmt.Fprintf(w, "%s_count%s %d\n", s.name, s.labels, s.count)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %g\n", s.name, s.labels, s.value)
+	}
+}
+
+// prometheusType returns the exposition type of a kind
+func prometheusType(kind Kind) string {
+	switch kind {
+	case KindCounter:
+		return "counter"
+	case KindGauge:
+		return "gauge"
+	default:
+		return "summary"
+	}
+}
+
+// prometheusName converts a CloudWatch metric name such as
+// InstancesProvisioned to instances_provisioned_total
+func prometheusName(d Datum) string {
+	name := snakeCase(d.Name)
+
+	switch d.Unit {
+	case types.StandardUnitMilliseconds:
+		name += "_milliseconds"
+	case types.StandardUnitSeconds:
+		name += "_seconds"
+	}
+
+	if d.Kind == KindCounter {
+		name += "_total"
+	}
+
+	return name
+}
+
+// prometheusLabels renders the non-empty dimensions as a label set
+func prometheusLabels(dims Dimensions) string {
+	list := dims.list()
+	if len(list) == 0 {
+		return ""
+	}
+
+	labels := make([]string, 0, len(list))
+	for _, dim := range list {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(dim.Value)
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, snakeCase(dim.Name), value))
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// snakeCase converts CamelCase to snake_case
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// DefaultNamespace is the CloudWatch namespace metrics are published to
+// unless another one is configured
+const DefaultNamespace = "EC2ProvisioningMetrics"
+
+// Metric names
+const (
+	InstancesProvisioned = "InstancesProvisioned"
+	InstancesTerminated  = "InstancesTerminated"
+	ActiveEnvironments   = "ActiveEnvironments"
+	ActiveInstances      = "ActiveInstances"
+	ActiveInstancesTotal = "ActiveInstancesTotal"
+	InstanceHours        = "InstanceHours"
+	DriftFindings        = "DriftFindings"
+	SpotInterruptions    = "SpotInterruptions"
+)
+
+// Outcome dimension values
+const (
+	OutcomeSuccess = "Success"
+	OutcomeFailure = "Failure"
+)
+
+// Dimensions are the dimensions attached to a metric. Empty
+// values are left out of the published datum.
+type Dimensions struct {
+	Environment  string
+	Region       string
+	InstanceType string
+	Outcome      string
+	ErrorCode    string
+	Finding      string
+	Owner        string
+}
+
+// Kind is how a datum aggregates
+type Kind int
+
+const (
+	// KindCounter values are summed
+	KindCounter Kind = iota
+
+	// KindGauge values replace the previous value
+	KindGauge
+
+	// KindDistribution values are individual observations
+	KindDistribution
+)
+
+// Datum is a single buffered metric value
+type Datum struct {
+	Name       string
+	Kind       Kind
+	Unit       types.StandardUnit
+	Dimensions Dimensions
+	Value      float64
+}
+
+// Sink publishes the datums buffered by a Recorder
+type Sink interface {
+	Publish(ctx context.Context, datums []Datum) error
+}
+
+// Recorder buffers metric datums for a single invocation and
+// publishes them to its Sink with Flush.
+type Recorder struct {
+	mu     sync.Mutex
+	sink   Sink
+	datums []Datum
+}
+
+// NewRecorder returns an empty Recorder publishing to the configured
+// sink, see DefaultSink.
+func NewRecorder() *Recorder {
+	return NewRecorderWithSink(DefaultSink())
+}
+
+// NewRecorderWithSink returns an empty Recorder publishing to sink
+func NewRecorderWithSink(sink Sink) *Recorder {
+	return &Recorder{sink: sink}
+}
+
+// Count adds value to the counter with the given name and dimensions.
+// Counts with the same name and dimensions are summed into one datum.
+func (r *Recorder) Count(name string, value float64, dims Dimensions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, d := range r.datums {
+		if d.Name == name && d.Kind == KindCounter && d.Dimensions == dims {
+			r.datums[i].Value += value
+			return
+		}
+	}
+
+	r.datums = append(r.datums, Datum{Name: name, Kind: KindCounter, Unit: types.StandardUnitCount, Dimensions: dims, Value: value})
+}
+
+// Gauge sets the gauge with the given name and dimensions to value,
+// replacing any value buffered earlier in the invocation.
+func (r *Recorder) Gauge(name string, value float64, dims Dimensions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, d := range r.datums {
+		if d.Name == name && d.Kind == KindGauge && d.Dimensions == dims {
+			r.datums[i].Value = value
+			return
+		}
+	}
+
+	r.datums = append(r.datums, Datum{Name: name, Kind: KindGauge, Unit: types.StandardUnitCount, Dimensions: dims, Value: value})
+}
+
+// Record buffers a single observation with the given unit and dimensions
+func (r *Recorder) Record(name string, value float64, unit types.StandardUnit, dims Dimensions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.datums = append(r.datums, Datum{Name: name, Kind: KindDistribution, Unit: unit, Dimensions: dims, Value: value})
+}
+
+// Flush publishes every buffered datum and empties the buffer.
+// Errors are logged as well as returned, since callers usually
+// flush on their way out.
+func (r *Recorder) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	datums := r.datums
+	r.datums = nil
+	r.mu.Unlock()
+
+	if len(datums) == 0 {
+		return nil
+	}
+
+	if err := r.sink.Publish(ctx, datums); err != nil {
+		logging.Error(ctx, "Failed to publish metrics", err)
+		return err
+	}
+
+	return nil
+}
+
+// dimension is a single named dimension value
+type dimension struct {
+	Name  string
+	Value string
+}
+
+// list returns the non-empty dimensions in a fixed order
+func (d Dimensions) list() []dimension {
+	var dims []dimension
+	for _, dim := range []dimension{
+		{"Environment", d.Environment},
+		{"Region", d.Region},
+		{"InstanceType", d.InstanceType},
+		{"Outcome", d.Outcome},
+		{"ErrorCode", d.ErrorCode},
+		{"Finding", d.Finding},
+		{"Owner", d.Owner},
+	} {
+		if dim.Value != "" {
+			dims = append(dims, dim)
+		}
+	}
+	return dims
+}
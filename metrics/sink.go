@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"os"
+	"sync"
+)
+
+// Sinks selected with Configure
+const (
+	// ModeAPI publishes through the PutMetricData API
+	ModeAPI = "api"
+
+	// ModeEMF writes Embedded Metric Format log lines to stdout
+	ModeEMF = "emf"
+
+	// ModePrometheus keeps the values in process for scraping,
+	// see PrometheusHandler
+	ModePrometheus = "prometheus"
+)
+
+var (
+	configMu  sync.RWMutex
+	mode      = ModeAPI
+	namespace = DefaultNamespace
+)
+
+// Configure selects the sink returned by DefaultSink and the namespace
+// metrics are published to. It is called once at cold start.
+func Configure(sinkMode string, metricsNamespace string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	mode = sinkMode
+	if metricsNamespace != "" {
+		namespace = metricsNamespace
+	}
+}
+
+// Namespace returns the namespace metrics are published to
+func Namespace() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return namespace
+}
+
+// DefaultSink returns the configured sink, defaulting to the CloudWatch
+// API. The Prometheus sink is shared by every Recorder in the process so
+// that /metrics reports totals.
+func DefaultSink() Sink {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	switch mode {
+	case ModeEMF:
+		return EMFSink{Writer: os.Stdout}
+	case ModePrometheus:
+		return defaultPrometheus
+	default:
+		return CloudWatchSink{}
+	}
+}
@@ -36,6 +36,11 @@ resource "aws_dynamodb_table" "env_tracker_dynamo_db" {
     type = "N"
   }
 
+  attribute {
+    name = "instance_id"
+    type = "S"
+  }
+
   ttl {
     attribute_name = "TTL"
     enabled        = true
@@ -48,9 +53,52 @@ resource "aws_dynamodb_table" "env_tracker_dynamo_db" {
     projection_type = "ALL"
   }
 
+  // The record of an instance, see the spot interruption handler
+  global_secondary_index {
+    name            = "InstanceIndex"
+    hash_key        = "instance_id"
+    projection_type = "ALL"
+  }
+
   tags = merge(var.tags, {
     Name        = "${var.environment}-dynamodb-table"
     Environment = var.environment
     TTL         = local.ttl_expiry_time
   })
 }
+
+// Append-only audit trail of lifecycle events, keyed by environment
+resource "aws_dynamodb_table" "env_events_dynamo_db" {
+  name         = "dynamodb-events-${var.client_id}-${random_id.id.hex}"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "environment"
+  range_key    = "event_id"
+
+  attribute {
+    name = "environment"
+    type = "S"
+  }
+
+  attribute {
+    name = "event_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "provision_id"
+    type = "S"
+  }
+
+  // The events of one provisioning, see audit.History
+  global_secondary_index {
+    name            = "ProvisionIndex"
+    hash_key        = "provision_id"
+    range_key       = "event_id"
+    projection_type = "ALL"
+  }
+
+  tags = merge(var.tags, {
+    Name        = "${var.environment}-events-table"
+    Environment = var.environment
+  })
+}
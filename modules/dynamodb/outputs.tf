@@ -5,3 +5,7 @@ output "ttl_expiry_time" {
 output "aws_dynamodb_table" {
   value = aws_dynamodb_table.env_tracker_dynamo_db
 }
+
+output "aws_dynamodb_events_table" {
+  value = aws_dynamodb_table.env_events_dynamo_db
+}
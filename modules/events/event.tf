@@ -33,4 +33,28 @@ resource "aws_cloudwatch_event_target" "cleanup_lambda" {
   rule      = aws_cloudwatch_event_rule.environment_cleanup.name
   target_id = "EnvironmentCleanupLambda"
   arn       = var.cleanup_lambda_arn # This is the ARN of the Lambda function
-}
\ No newline at end of file
+}
+
+# EventBridge rule forwarding spot interruption warnings. EC2 sends them
+# in the region of the instance, so spot environments in other regions
+# need the rule there as well.
+resource "aws_cloudwatch_event_rule" "spot_interruption" {
+  name        = "spot-interruption-warning"
+  description = "End environments whose spot instance is reclaimed"
+
+  event_pattern = jsonencode({
+    source      = ["aws.ec2"]
+    detail-type = ["EC2 Spot Instance Interruption Warning"]
+  })
+
+  tags = {
+    Environment = var.environment
+    Managed_By  = "terraform"
+  }
+}
+
+resource "aws_cloudwatch_event_target" "spot_interruption_lambda" {
+  rule      = aws_cloudwatch_event_rule.spot_interruption.name
+  target_id = "SpotInterruptionLambda"
+  arn       = var.spot_interruption_lambda_arn
+}
@@ -1,3 +1,7 @@
 output "environement_cleanup" {
   value = aws_cloudwatch_event_rule.environment_cleanup.arn
-}
\ No newline at end of file
+}
+
+output "spot_interruption" {
+  value = aws_cloudwatch_event_rule.spot_interruption.arn
+}
@@ -12,4 +12,9 @@ variable "cleanup_lambda_arn" {
 variable "client_id" {
   description = "The client ID"
   type        = string
-}
\ No newline at end of file
+}
+
+variable "spot_interruption_lambda_arn" {
+  description = "The ARN of the Lambda function handling spot interruptions"
+  type        = string
+}
@@ -22,7 +22,7 @@ resource "aws_iam_role_policy" "lambda_permissions" {
 
   policy = jsonencode({
     Version = "2012-10-17"
-    Statement = [
+    Statement = concat([
       {
         Effect = "Allow"
         Action = [
@@ -39,10 +39,34 @@ resource "aws_iam_role_policy" "lambda_permissions" {
           "dynamodb:UpdateItem",
           "dynamodb:GetItem",
           "dynamodb:DeleteItem",
+          "dynamodb:Query",
+          "dynamodb:Scan"
+        ]
+        Resource = [var.table_arn, "${var.table_arn}/index/*"]
+      },
+      {
+        // The audit trail is append-only: events are recorded and read,
+        // never changed or deleted
+        Effect = "Allow"
+        Action = [
+          "dynamodb:PutItem",
+          "dynamodb:Query"
+        ]
+        Resource = [var.events_table_arn, "${var.events_table_arn}/index/*"]
+      },
+      {
+        Effect = "Allow"
+        Action = [
+          "ssm:GetParameter",
+          "ssm:GetParametersByPath",
 
           "ec2:DescribeInstances",
+          "ec2:DescribeInstanceTypes",
+          "ec2:DescribeImages",
           "ec2:RunInstances",
           "ec2:TerminateInstances",
+          "ec2:CreateTags",
+          "ec2:DescribeLaunchTemplateVersions",
 
           "apigateway:GET",
           "apigateway:PUT",
@@ -51,11 +75,42 @@ resource "aws_iam_role_policy" "lambda_permissions" {
         ]
         Resource = "*"
         # Resource: "arn:aws:apigateway:us-east-1::/restapis/*/stages/*"
+      },
+      {
+        // The default metrics mode publishes through the CloudWatch API.
+        // PutMetricData has no resource, so it is scoped by namespace.
+        Effect   = "Allow"
+        Action   = "cloudwatch:PutMetricData"
+        Resource = "*"
+        Condition = {
+          StringEquals = {
+            "cloudwatch:namespace" = local.metrics_namespace
+          }
+        }
       }
-    ]
+      ], length(var.instance_profile_role_arns) == 0 ? [] : [
+      {
+        // Requests and launch templates may attach an instance profile
+        // holding one of these roles, to EC2 instances only
+        Effect   = "Allow"
+        Action   = "iam:PassRole"
+        Resource = var.instance_profile_role_arns
+        Condition = {
+          StringEquals = {
+            "iam:PassedToService" = "ec2.amazonaws.com"
+          }
+        }
+      }
+    ])
   })
 }
 
+// The namespace the functions publish metrics to, appconfig's default
+// MetricsNamespace
+locals {
+  metrics_namespace = "EC2ProvisioningMetrics"
+}
+
 // Lambda build automation
 resource "null_resource" "build_lambdas" {
   provisioner "local-exec" {
@@ -88,8 +143,10 @@ resource "aws_lambda_function" "cleanupenv" {
 
   environment {
     variables = {
+      HANDLER     = "cleanup"
       ENVIRONMENT = var.environment_tag
       TABLE_NAME  = var.table_name
+      CLIENT_ID   = var.client_id
     }
   }
 }
@@ -101,6 +158,75 @@ resource "aws_lambda_function" "provisionenv" {
   handler       = "main"
   filename      = local.lambda_functions["provisionenv"].filepath
   depends_on    = [null_resource.build_lambdas]
+
+  environment {
+    variables = {
+      HANDLER      = "provision"
+      ENVIRONMENT  = var.environment_tag
+      TABLE_NAME   = var.table_name
+      CLIENT_ID    = var.client_id
+      ADMIN_GROUPS = var.admin_groups
+    }
+  }
+}
+
+// Teardown, extend and pin run from the provisioning build with their own handler
+resource "aws_lambda_function" "lifecycleenv" {
+  function_name = "lifecycle_lambda"
+  role          = aws_iam_role.lambda_exec.arn
+  runtime       = "provided.al2"
+  handler       = "main"
+  filename      = local.lambda_functions["provisionenv"].filepath
+  depends_on    = [null_resource.build_lambdas]
+
+  environment {
+    variables = {
+      HANDLER      = "lifecycle"
+      ENVIRONMENT  = var.environment_tag
+      TABLE_NAME   = var.table_name
+      CLIENT_ID    = var.client_id
+      ADMIN_GROUPS = var.admin_groups
+    }
+  }
+}
+
+// The audit history is served from the same build
+resource "aws_lambda_function" "history" {
+  function_name = "history_lambda"
+  role          = aws_iam_role.lambda_exec.arn
+  runtime       = "provided.al2"
+  handler       = "main"
+  filename      = local.lambda_functions["provisionenv"].filepath
+  depends_on    = [null_resource.build_lambdas]
+
+  environment {
+    variables = {
+      HANDLER      = "history"
+      ENVIRONMENT  = var.environment_tag
+      TABLE_NAME   = var.table_name
+      CLIENT_ID    = var.client_id
+      ADMIN_GROUPS = var.admin_groups
+    }
+  }
+}
+
+// Spot interruption warnings end environments from the same build
+resource "aws_lambda_function" "spotinterruption" {
+  function_name = "spot_interruption_lambda"
+  role          = aws_iam_role.lambda_exec.arn
+  runtime       = "provided.al2"
+  handler       = "main"
+  filename      = local.lambda_functions["provisionenv"].filepath
+  depends_on    = [null_resource.build_lambdas]
+
+  environment {
+    variables = {
+      HANDLER     = "spot-interruption"
+      ENVIRONMENT = var.environment_tag
+      TABLE_NAME  = var.table_name
+      CLIENT_ID   = var.client_id
+    }
+  }
 }
 
 // Single HTTP API Gateway for both functions
@@ -109,6 +235,19 @@ resource "aws_apigatewayv2_api" "lambda_api" {
   protocol_type = "HTTP"
 }
 
+// Every route requires a JWT; the handlers take the caller from its claims
+resource "aws_apigatewayv2_authorizer" "jwt" {
+  api_id           = aws_apigatewayv2_api.lambda_api.id
+  authorizer_type  = "JWT"
+  identity_sources = ["$request.header.Authorization"]
+  name             = "jwt-authorizer"
+
+  jwt_configuration {
+    issuer   = var.jwt_issuer
+    audience = var.jwt_audience
+  }
+}
+
 // Integration for cleanupenv & provisionenv
 resource "aws_apigatewayv2_integration" "cleanup_integration" {
   api_id                 = aws_apigatewayv2_api.lambda_api.id
@@ -126,17 +265,57 @@ resource "aws_apigatewayv2_integration" "provision_integration" {
   payload_format_version = "2.0"
 }
 
+resource "aws_apigatewayv2_integration" "lifecycle_integration" {
+  api_id                 = aws_apigatewayv2_api.lambda_api.id
+  integration_type       = "AWS_PROXY"
+  integration_method     = "POST"
+  integration_uri        = aws_lambda_function.lifecycleenv.invoke_arn
+  payload_format_version = "2.0"
+}
+
+resource "aws_apigatewayv2_integration" "history_integration" {
+  api_id                 = aws_apigatewayv2_api.lambda_api.id
+  integration_type       = "AWS_PROXY"
+  integration_method     = "POST"
+  integration_uri        = aws_lambda_function.history.invoke_arn
+  payload_format_version = "2.0"
+}
+
 // Routes for cleanupenv & provisionenv
 resource "aws_apigatewayv2_route" "cleanup_route" {
   api_id    = aws_apigatewayv2_api.lambda_api.id
   route_key = "ANY /cleanupenv"
   target    = "integrations/${aws_apigatewayv2_integration.cleanup_integration.id}"
+
+  authorization_type = "JWT"
+  authorizer_id      = aws_apigatewayv2_authorizer.jwt.id
 }
 
 resource "aws_apigatewayv2_route" "provision_route" {
   api_id    = aws_apigatewayv2_api.lambda_api.id
   route_key = "ANY /provision"
   target    = "integrations/${aws_apigatewayv2_integration.provision_integration.id}"
+
+  authorization_type = "JWT"
+  authorizer_id      = aws_apigatewayv2_authorizer.jwt.id
+}
+
+resource "aws_apigatewayv2_route" "lifecycle_route" {
+  api_id    = aws_apigatewayv2_api.lambda_api.id
+  route_key = "POST /lifecycle"
+  target    = "integrations/${aws_apigatewayv2_integration.lifecycle_integration.id}"
+
+  authorization_type = "JWT"
+  authorizer_id      = aws_apigatewayv2_authorizer.jwt.id
+}
+
+resource "aws_apigatewayv2_route" "history_route" {
+  api_id    = aws_apigatewayv2_api.lambda_api.id
+  route_key = "GET /history"
+  target    = "integrations/${aws_apigatewayv2_integration.history_integration.id}"
+
+  authorization_type = "JWT"
+  authorizer_id      = aws_apigatewayv2_authorizer.jwt.id
 }
 
 // Lambda permissions for API Gateway
@@ -156,6 +335,22 @@ resource "aws_lambda_permission" "provisionenv" {
   source_arn    = "${aws_apigatewayv2_api.lambda_api.execution_arn}/*"
 }
 
+resource "aws_lambda_permission" "lifecycleenv" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.lifecycleenv.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.lambda_api.execution_arn}/*"
+}
+
+resource "aws_lambda_permission" "history" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.history.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.lambda_api.execution_arn}/*"
+}
+
 # Lambda permission
 resource "aws_lambda_permission" "allow_eventbridge_invoke" {
   statement_id  = "AllowEventBridgeInvoke"
@@ -165,3 +360,11 @@ resource "aws_lambda_permission" "allow_eventbridge_invoke" {
   # source_arn    = aws_cloudwatch_event_rule.environement_cleanup.arn
   source_arn = var.source_arn
 }
+
+resource "aws_lambda_permission" "allow_spot_interruption_invoke" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.spotinterruption.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = var.spot_interruption_source_arn
+}
@@ -6,6 +6,10 @@ output "aws_cleanup_lambda_arn" {
   value = aws_lambda_function.cleanupenv.arn
 }
 
+output "aws_spot_interruption_lambda_arn" {
+  value = aws_lambda_function.spotinterruption.arn
+}
+
 output "aws_iam_role_lambda_exec_arn" {
   value = aws_iam_role.lambda_exec.arn
 }
\ No newline at end of file
@@ -6,6 +6,21 @@ variable "table_name" {
   type = string
 }
 
+variable "table_arn" {
+  description = "ARN of the tracking table"
+  type        = string
+}
+
+variable "events_table_arn" {
+  description = "ARN of the append-only events table"
+  type        = string
+}
+
+variable "client_id" {
+  description = "The team provision requests are counted against unless an admin names another"
+  type        = string
+}
+
 variable "terraform_dir" {
   type = string
 
@@ -13,4 +28,30 @@ variable "terraform_dir" {
 
 variable "source_arn" {
   type = string
-}
\ No newline at end of file
+}
+
+variable "spot_interruption_source_arn" {
+  description = "The ARN of the EventBridge rule forwarding spot interruption warnings"
+  type        = string
+}
+variable "instance_profile_role_arns" {
+  description = "ARNs of the roles of the instance profiles environments may be launched with"
+  type        = list(string)
+  default     = []
+}
+
+variable "admin_groups" {
+  description = "Comma separated groups that may tear down, extend and pin any environment"
+  type        = string
+  default     = ""
+}
+
+variable "jwt_issuer" {
+  description = "Issuer of the JWTs the API accepts, e.g. the Cognito user pool URL"
+  type        = string
+}
+
+variable "jwt_audience" {
+  description = "Audiences (app client IDs) the API accepts JWTs for"
+  type        = list(string)
+}
@@ -28,7 +28,11 @@ resource "aws_lambda_function" "monitor_drift_lambda" {
 
   environment {
     variables = {
-      REGION = var.region
+      HANDLER     = "drift"
+      REGION      = var.region
+      ENVIRONMENT = var.environment_tag
+      TABLE_NAME  = var.table_name
+      CLIENT_ID   = var.client_id
     }
   }
 }
@@ -4,4 +4,17 @@ variable "region" {
 
 variable "monitor_drift_lambda_role" {
   type = string
-}
\ No newline at end of file
+}
+
+variable "environment_tag" {
+  type = string
+}
+
+variable "table_name" {
+  type = string
+}
+
+variable "client_id" {
+  description = "The team provision requests are counted against"
+  type        = string
+}
@@ -3,4 +3,17 @@ resource "aws_ssm_parameter" "dynamodb_table_name" {
   type = "String"
   #   value = aws_dynamodb_table.env_tracker_dynamo_db.name
   value = var.dynamodb_table_name
-}
\ No newline at end of file
+}
+resource "aws_ssm_parameter" "dynamodb_events_table_name" {
+  name  = "/project-r3/${var.environment}/dynamodb/events-table-name"
+  type  = "String"
+  value = var.dynamodb_events_table_name
+}
+
+// Provision policy of the environment, see the policy package
+resource "aws_ssm_parameter" "provision_policy" {
+  count = var.provision_policy == null ? 0 : 1
+  name  = "/project-r3/${var.environment}/provision-policy"
+  type  = "String"
+  value = jsonencode(var.provision_policy)
+}
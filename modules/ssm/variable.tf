@@ -8,4 +8,13 @@ variable "table-type" {
 
 variable "dynamodb_table_name" {
   type = string
-}
\ No newline at end of file
+}
+variable "dynamodb_events_table_name" {
+  type = string
+}
+
+variable "provision_policy" {
+  description = "Allowed instance types, AMIs, subnets, maximum TTL and required tags of provision requests"
+  type        = any
+  default     = null
+}
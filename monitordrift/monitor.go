@@ -3,10 +3,16 @@ package monitordrift
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/audit"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
 	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/cleanupenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
 	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/30Piraten/aws-dynamicEventBuilder/metrics"
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -15,99 +21,438 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 )
 
-// ActiveInstance represents the structure of an instance record in DynamoDB
-type ActiveInstance struct {
-	ID         string `dynamodbv:"ID"`
-	InstanceID string `dynamodbv:"instance_id"`
-	Status     string `dynamodbv:"status"`
+// TrackedInstance represents the structure of an instance record in DynamoDB
+// that has not yet been marked as terminated
+type TrackedInstance struct {
+	ID          string `dynamodbav:"ID"`
+	Environment string `dynamodbav:"environment"`
+	Region      string `dynamodbav:"region"`
+	InstanceID  string `dynamodbav:"instance_id"`
+	Team        string `dynamodbav:"team"`
+	VCPUs       int    `dynamodbav:"vcpus"`
+	Status      string `dynamodbav:"status"`
 }
 
-func monitorDrift(ctx context.Context, environment string, tableType string) error {
-	config, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to load AWS config: %v", err)
+// instanceInfo is the part of an EC2 instance description drift detection needs
+type instanceInfo struct {
+	State  ec2Types.InstanceStateName
+	Region string
+
+	// Managed is true when the instance carries the service tag set
+	// at provisioning time
+	Managed bool
+
+	// Environment is the value of the instance's Environment tag
+	Environment string
+
+	LaunchTime time.Time
+}
+
+// NewDriftHandler returns the handler for the scheduled drift check. The
+// remediation mode and safety limits come from the service configuration.
+func NewDriftHandler(cfg *appconfig.Config) func(context.Context, events.CloudWatchEvent) error {
+	return func(ctx context.Context, event events.CloudWatchEvent) error {
+		ctx = logging.WithLambdaRequest(ctx)
+		return monitorDrift(ctx, cfg, OptionsFromConfig(cfg))
 	}
+}
 
-	ec2Client := ec2.NewFromConfig(config)
-	dynamodbClient := dynamodb.NewFromConfig(config)
+// monitorDrift compares the tracked instances in DynamoDB against EC2 and
+// applies the resulting changes according to opts. The whole plan is built
+// before anything is changed, so a run that trips the circuit breaker
+// makes no changes at all. Every tracked instance is checked in the region
+// it was provisioned in, while orphans are only looked for in the sweep
+// regions of opts.
+func monitorDrift(ctx context.Context, cfg *appconfig.Config, opts Options) error {
+	environment := cfg.Environment
 
-	// Fetch all active instances from DynamoDB
-	activeInstances, err := getActiveInstances(ctx, dynamodbClient)
+	dynamodbClient, err := awsclient.Default().DynamoDB(ctx, awsclient.HomeRegion)
 	if err != nil {
-		return fmt.Errorf("failed to fetch active instances: %v", err)
+		return fmt.Errorf("failed to load AWS config: %v", err)
 	}
 
-	// Fetch all running instances from EC2
-	runningInstances, err := listRunningInstances(ctx, ec2Client)
+	// Fetch all tracked (active or stopped) instances from DynamoDB
+	trackedInstances, err := getTrackedInstances(ctx, dynamodbClient, cfg.TrackingTable)
 	if err != nil {
-		return fmt.Errorf("failed to fetch running instances: %v", err)
+		return fmt.Errorf("failed to fetch tracked instances: %v", err)
 	}
 
-	// Compare active instances in DynamoDB against running EC2 instances
-	for _, activeInstance := range activeInstances {
-		if !instanceExistsInEC2(runningInstances, activeInstance.InstanceID) {
-			logging.LogInfo(fmt.Sprintf("Instance %s (ProvisionID: %s) not found in EC2, marking as TERMINATED", activeInstance.InstanceID, activeInstance.ID))
+	// Fetch the state of every instance in the sweep regions. A region
+	// that cannot be listed aborts the run rather than making its
+	// instances look gone.
+	instances := make(map[string]instanceInfo)
+	for _, region := range opts.sweepRegions() {
+		ec2Client, err := awsclient.Default().EC2(ctx, region)
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config: %v", err)
+		}
 
-			if err := cleanupenv.MarkInstanceAsTerminated(ctx, dynamodbClient, activeInstance.ID, environment, tableType); err != nil {
-				logging.LogError(fmt.Sprintf("Failed to update DynamoDB status for InstanceID: %s: %v", activeInstance.InstanceID, err), err)
+		listed, err := listInstanceStates(ctx, ec2Client, region, cfg.ServiceTag)
+		if err != nil {
+			return fmt.Errorf("failed to fetch instance states in region %q: %v", region, err)
+		}
+		for id, info := range listed {
+			instances[id] = info
+		}
+	}
+
+	// Instances missing from the listing are looked up again by ID in
+	// their own region before they are treated as gone, so one bad page
+	// cannot terminate everything
+	missing := make(map[string][]string)
+	for _, tracked := range trackedInstances {
+		if _, found := instances[tracked.InstanceID]; !found {
+			missing[tracked.Region] = append(missing[tracked.Region], tracked.InstanceID)
+		}
+	}
+	for region, ids := range missing {
+		ec2Client, err := awsclient.Default().EC2(ctx, region)
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config: %v", err)
+		}
+
+		confirmed, err := describeInstancesByID(ctx, ec2Client, region, ids, cfg.ServiceTag)
+		if err != nil {
+			return fmt.Errorf("failed to confirm missing instances in region %q: %v", region, err)
+		}
+		for id, info := range confirmed {
+			instances[id] = info
+		}
+	}
+
+	plan := planChanges(trackedInstances, instances, environment, time.Now(), opts.OrphanGrace)
+
+	recorder := metrics.NewRecorder()
+	defer recorder.Flush(ctx)
+	recordActiveEnvironments(recorder, environment, trackedInstances, instances)
+
+	for _, change := range plan {
+		ctx := logging.WithField(ctx, logging.ProvisionID, change.ProvisionID)
+		logging.Info(ctx, "Drift detected", logging.Fields{
+			"mode":              opts.Mode,
+			"change":            change.Kind,
+			logging.InstanceID:  change.InstanceID,
+			logging.Environment: environment,
+			logging.Region:      change.Region,
+			"from":              change.From,
+			"to":                change.To,
+		})
+		recorder.Count(metrics.DriftFindings, 1, metrics.Dimensions{
+			Environment: environment,
+			Region:      change.Region,
+			Finding:     string(change.Kind),
+		})
+	}
+
+	// Orphans are only acted upon when reconciling
+	if opts.Mode == ModeFixState {
+		plan = withoutOrphans(plan)
+	}
+
+	if err := opts.checkLimits(plan, len(trackedInstances)+countOrphans(plan)); err != nil {
+		// A report changes nothing, so the breaker only warns
+		if opts.Mode == ModeReport {
+			logging.Warn(ctx, "Drift exceeds the remediation limits", logging.Fields{logging.Environment: environment, "planned_changes": len(plan), "error": err.Error()})
+			return nil
+		}
+		logging.Error(ctx, "Aborting drift remediation without changes", err, logging.Fields{logging.Environment: environment, "planned_changes": len(plan)})
+		return err
+	}
+
+	if opts.Mode == ModeReport {
+		return nil
+	}
+
+	for _, change := range plan {
+		ctx := logging.WithField(ctx, logging.ProvisionID, change.ProvisionID)
+		switch change.Kind {
+		case changeStatus:
+			update := func() error {
+				return cleanupenv.UpdateInstanceStatus(ctx, dynamodbClient, change.ProvisionID, change.To, cfg.TrackingTable)
+			}
+			// A terminated instance hands its quota back
+			if change.To == provisionenv.StatusTerminated {
+				update = func() error {
+					return cleanupenv.MarkInstanceAsTerminated(ctx, dynamodbClient, change.ProvisionID, change.Team, change.VCPUs, cfg.TrackingTable)
+				}
+			}
+			if err := update(); err != nil {
+				logging.Error(ctx, "Failed to update DynamoDB status", err, logging.Fields{logging.InstanceID: change.InstanceID, logging.Status: change.To})
+				continue
+			}
+		case changeTerminate:
+			ec2Client, err := awsclient.Default().EC2(ctx, change.Region)
+			if err != nil {
+				logging.Error(ctx, "Failed to terminate orphaned instance", err, logging.Fields{logging.InstanceID: change.InstanceID, logging.Region: change.Region})
+				continue
+			}
+			if _, err := ec2Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+				InstanceIds: []string{change.InstanceID},
+			}); err != nil {
+				logging.Error(ctx, "Failed to terminate orphaned instance", err, logging.Fields{logging.InstanceID: change.InstanceID, logging.Region: change.Region})
+				continue
 			}
 		}
+
+		// Record the remediation in the audit trail
+		if err := audit.Record(ctx, cfg.EventsTable, audit.Event{
+			Environment: environment,
+			Action:      audit.ActionDriftRemediation,
+			Actor:       audit.ActorDrift,
+			ProvisionID: change.ProvisionID,
+			InstanceID:  change.InstanceID,
+			Before:      map[string]string{"status": change.From},
+			After:       map[string]string{"status": change.To},
+			Reason:      fmt.Sprintf("%s (%s)", change.Kind, opts.Mode),
+		}); err != nil {
+			logging.Error(ctx, "Failed to record audit event", err, logging.Fields{logging.InstanceID: change.InstanceID})
+		}
 	}
 	return nil
 }
 
-func getActiveInstances(ctx context.Context, client *dynamodb.Client) ([]ActiveInstance, error) {
+// planChanges builds the list of changes needed to bring DynamoDB in line
+// with EC2. Instances are unique across regions, so one map covers every
+// region. An instance is planned for termination as an orphan only when
+// isOrphan says so.
+func planChanges(trackedInstances []TrackedInstance, instances map[string]instanceInfo, environment string, now time.Time, grace time.Duration) []plannedChange {
+	var plan []plannedChange
+
+	tracked := make(map[string]bool, len(trackedInstances))
+	for _, t := range trackedInstances {
+		tracked[t.InstanceID] = true
+
+		info, found := instances[t.InstanceID]
+		status := lifecycleStatus(info.State, found)
+		if status == "" || status == t.Status {
+			continue
+		}
+
+		plan = append(plan, plannedChange{
+			Kind:        changeStatus,
+			Region:      t.Region,
+			ProvisionID: t.ID,
+			Team:        t.Team,
+			VCPUs:       t.VCPUs,
+			InstanceID:  t.InstanceID,
+			From:        t.Status,
+			To:          status,
+		})
+	}
+
+	for id, info := range instances {
+		if tracked[id] || !isOrphan(info, environment, now, grace) {
+			continue
+		}
 
-	// Query DyanmoDB for active instances
+		plan = append(plan, plannedChange{
+			Kind:       changeTerminate,
+			Region:     info.Region,
+			InstanceID: id,
+			From:       string(info.State),
+			To:         string(ec2Types.InstanceStateNameTerminated),
+		})
+	}
+
+	return plan
+}
+
+// isOrphan reports whether an untracked instance is an orphan of this
+// environment: it carries the service tag and the environment's tag, is
+// still alive, and was launched more than grace ago. The environment tag
+// keeps one environment's drift run away from the instances of another
+// sharing the account, and the grace period covers the gap between
+// RunInstances and the record being stored. An instance without a launch
+// time is never an orphan.
+func isOrphan(info instanceInfo, environment string, now time.Time, grace time.Duration) bool {
+	if !info.Managed || info.Environment != environment {
+		return false
+	}
+	if lifecycleStatus(info.State, true) == provisionenv.StatusTerminated {
+		return false
+	}
+	if info.LaunchTime.IsZero() || now.Sub(info.LaunchTime) < grace {
+		return false
+	}
+	return true
+}
+
+// recordActiveEnvironments sets the ActiveEnvironments gauge per
+// environment from the state EC2 reports for each tracked instance
+func recordActiveEnvironments(recorder *metrics.Recorder, environment string, trackedInstances []TrackedInstance, instances map[string]instanceInfo) {
+	active := map[string]int{environment: 0}
+	for _, t := range trackedInstances {
+		info, found := instances[t.InstanceID]
+		if lifecycleStatus(info.State, found) == provisionenv.StatusActive {
+			active[t.Environment]++
+		}
+	}
+
+	for env, count := range active {
+		recorder.Gauge(metrics.ActiveEnvironments, float64(count), metrics.Dimensions{Environment: env})
+	}
+}
+
+// withoutOrphans returns the plan without its orphan terminations
+func withoutOrphans(plan []plannedChange) []plannedChange {
+	var filtered []plannedChange
+	for _, change := range plan {
+		if change.Kind != changeTerminate {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered
+}
+
+// countOrphans returns the number of orphan terminations in the plan
+func countOrphans(plan []plannedChange) int {
+	n := 0
+	for _, change := range plan {
+		if change.Kind == changeTerminate {
+			n++
+		}
+	}
+	return n
+}
+
+// lifecycleStatus maps an EC2 instance state onto the lifecycle status stored
+// in DynamoDB. An instance that EC2 no longer reports is terminated. An empty
+// string is returned for states that should leave the record untouched.
+func lifecycleStatus(state ec2Types.InstanceStateName, found bool) string {
+	if !found {
+		return provisionenv.StatusTerminated
+	}
+
+	switch state {
+	case ec2Types.InstanceStateNamePending, ec2Types.InstanceStateNameRunning:
+		return provisionenv.StatusActive
+	case ec2Types.InstanceStateNameStopping, ec2Types.InstanceStateNameStopped:
+		return provisionenv.StatusStopped
+	case ec2Types.InstanceStateNameShuttingDown, ec2Types.InstanceStateNameTerminated:
+		return provisionenv.StatusTerminated
+	default:
+		return ""
+	}
+}
+
+func getTrackedInstances(ctx context.Context, client *dynamodb.Client, tableName string) ([]TrackedInstance, error) {
+
+	// Query DyanmoDB for active and stopped instances
 	input := &dynamodb.ScanInput{
-		TableName:        aws.String("dev-dynamodb-table"),
-		FilterExpression: aws.String("Status = :status"),
+		TableName:        aws.String(tableName),
+		FilterExpression: aws.String("#status IN (:active, :stopped)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":status": &types.AttributeValueMemberS{
-				Value: "ACTIVE",
+			":active": &types.AttributeValueMemberS{
+				Value: provisionenv.StatusActive,
+			},
+			":stopped": &types.AttributeValueMemberS{
+				Value: provisionenv.StatusStopped,
 			},
 		},
 	}
 
-	result, err := client.Scan(ctx, input)
-	if err != nil {
-		return nil, fmt.Errorf("error querying DynamoDb: %v", err)
+	// A scan returns at most 1 MB per page
+	var trackedInstances []TrackedInstance
+	paginator := dynamodb.NewScanPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error querying DynamoDb: %v", err)
+		}
+
+		var items []TrackedInstance
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, fmt.Errorf("error unmarshalling DynamoDB results: %v", err)
+		}
+		trackedInstances = append(trackedInstances, items...)
 	}
 
-	var activeInstances []ActiveInstance
-	if err := attributevalue.UnmarshalListOfMaps(result.Items, &activeInstances); err != nil {
+	return trackedInstances, nil
+}
+
+// listInstanceStates returns the current state of every instance EC2 reports
+// in the region of client, keyed by instance ID.
+func listInstanceStates(ctx context.Context, client *ec2.Client, region string, serviceTag string) (map[string]instanceInfo, error) {
+	instances := make(map[string]instanceInfo)
 
-		return nil, fmt.Errorf("error unmarshalling DynamoDB results: %v", err)
+	paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		collectInstances(page.Reservations, instances, region, serviceTag)
 	}
 
-	return activeInstances, nil
+	return instances, nil
 }
 
-func listRunningInstances(ctx context.Context, client *ec2.Client) ([]string, error) {
-	input := &ec2.DescribeInstancesInput{}
-	result, err := client.DescribeInstances(ctx, input)
-	if err != nil {
-		return nil, err
+// describeInstancesByID looks up the given instances explicitly. Instances
+// EC2 does not return are absent from the result. An instance-id filter is
+// used rather than InstanceIds so that unknown IDs do not fail the call.
+func describeInstancesByID(ctx context.Context, client *ec2.Client, region string, instanceIDs []string, serviceTag string) (map[string]instanceInfo, error) {
+	instances := make(map[string]instanceInfo)
+
+	// EC2 accepts at most 200 values per filter
+	const batchSize = 200
+	for start := 0; start < len(instanceIDs); start += batchSize {
+		end := min(start+batchSize, len(instanceIDs))
+
+		paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{
+			Filters: []ec2Types.Filter{
+				{Name: aws.String("instance-id"), Values: instanceIDs[start:end]},
+			},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			collectInstances(page.Reservations, instances, region, serviceTag)
+		}
 	}
 
-	var instanceIDs []string
-	for _, response := range result.Reservations {
-		for _, inst := range response.Instances {
-			if inst.State.Name == ec2Types.InstanceStateNameRunning {
-				instanceIDs = append(instanceIDs, *inst.InstanceId)
+	return instances, nil
+}
+
+// collectInstances adds the instances of the given reservations to instances
+func collectInstances(reservations []ec2Types.Reservation, instances map[string]instanceInfo, region string, serviceTag string) {
+	for _, reservation := range reservations {
+		for _, inst := range reservation.Instances {
+			if inst.InstanceId == nil || inst.State == nil {
+				continue
+			}
+			instances[*inst.InstanceId] = instanceInfo{
+				State:       inst.State.Name,
+				Region:      region,
+				Managed:     hasServiceTag(inst.Tags, serviceTag),
+				Environment: tagValue(inst.Tags, "Environment"),
+				LaunchTime:  aws.TimeValue(inst.LaunchTime),
 			}
 		}
 	}
+}
 
-	return instanceIDs, nil
+// tagValue returns the value of the tag key, empty when it is not set
+func tagValue(tags []ec2Types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
 }
 
-func instanceExistsInEC2(runningInstances []string, instanceID string) bool {
-	for _, id := range runningInstances {
-		if id == instanceID {
+// hasServiceTag reports whether the tags mark the instance as provisioned
+// by this service
+func hasServiceTag(tags []ec2Types.Tag, serviceTag string) bool {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == "Service" && aws.StringValue(tag.Value) == serviceTag {
 			return true
 		}
 	}
-
 	return false
 }
@@ -0,0 +1,141 @@
+package monitordrift
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestPlanChanges(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	grace := 15 * time.Minute
+	old := now.Add(-time.Hour)
+
+	tests := []struct {
+		name      string
+		tracked   []TrackedInstance
+		instances map[string]instanceInfo
+		want      []string
+	}{
+		{
+			name:    "tracked and in sync",
+			tracked: []TrackedInstance{{ID: "p1", InstanceID: "i-1", Status: provisionenv.StatusActive}},
+			instances: map[string]instanceInfo{
+				"i-1": {State: ec2Types.InstanceStateNameRunning, Managed: true, Environment: "dev", LaunchTime: old},
+			},
+		},
+		{
+			name:    "tracked instance stopped",
+			tracked: []TrackedInstance{{ID: "p1", InstanceID: "i-1", Status: provisionenv.StatusActive}},
+			instances: map[string]instanceInfo{
+				"i-1": {State: ec2Types.InstanceStateNameStopped},
+			},
+			want: []string{"update-status i-1 ACTIVE->STOPPED"},
+		},
+		{
+			name:    "tracked instance gone",
+			tracked: []TrackedInstance{{ID: "p1", InstanceID: "i-1", Status: provisionenv.StatusStopped}},
+			want:    []string{"update-status i-1 STOPPED->TERMINATED"},
+		},
+		{
+			name:    "tracked instance in a transient state",
+			tracked: []TrackedInstance{{ID: "p1", InstanceID: "i-1", Status: provisionenv.StatusActive}},
+			instances: map[string]instanceInfo{
+				"i-1": {State: ec2Types.InstanceStateName("rebooting")},
+			},
+		},
+		{
+			name: "orphan of this environment",
+			instances: map[string]instanceInfo{
+				"i-2": {State: ec2Types.InstanceStateNameRunning, Managed: true, Environment: "dev", LaunchTime: old},
+			},
+			want: []string{"terminate-orphan i-2 running->terminated"},
+		},
+		{
+			name: "orphan of another environment",
+			instances: map[string]instanceInfo{
+				"i-2": {State: ec2Types.InstanceStateNameRunning, Managed: true, Environment: "prod", LaunchTime: old},
+			},
+		},
+		{
+			name: "unmanaged instance",
+			instances: map[string]instanceInfo{
+				"i-2": {State: ec2Types.InstanceStateNameRunning, Environment: "dev", LaunchTime: old},
+			},
+		},
+		{
+			name: "instance within the grace period",
+			instances: map[string]instanceInfo{
+				"i-2": {State: ec2Types.InstanceStateNameRunning, Managed: true, Environment: "dev", LaunchTime: now.Add(-time.Minute)},
+			},
+		},
+		{
+			name: "instance without launch time",
+			instances: map[string]instanceInfo{
+				"i-2": {State: ec2Types.InstanceStateNameRunning, Managed: true, Environment: "dev"},
+			},
+		},
+		{
+			name: "terminated orphan",
+			instances: map[string]instanceInfo{
+				"i-2": {State: ec2Types.InstanceStateNameShuttingDown, Managed: true, Environment: "dev", LaunchTime: old},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planChanges(tt.tracked, tt.instances, "dev", now, grace)
+
+			var got []string
+			for _, c := range plan {
+				got = append(got, string(c.Kind)+" "+c.InstanceID+" "+c.From+"->"+c.To)
+			}
+			sort.Strings(got)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("planChanges() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("planChanges()[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	opts := Options{MaxChanges: 20, MaxChangePercent: 50, MinInspected: 10}
+
+	tests := []struct {
+		name      string
+		changes   int
+		inspected int
+		open      bool
+	}{
+		{name: "no changes", changes: 0, inspected: 0},
+		{name: "single change in a small fleet", changes: 1, inspected: 1},
+		{name: "whole small fleet", changes: 9, inspected: 9},
+		{name: "half of a large fleet", changes: 5, inspected: 10},
+		{name: "over half of a large fleet", changes: 6, inspected: 10, open: true},
+		{name: "at the absolute limit", changes: 20, inspected: 100},
+		{name: "over the absolute limit", changes: 21, inspected: 100, open: true},
+		{name: "over the absolute limit in a small fleet", changes: 21, inspected: 5, open: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := make([]plannedChange, tt.changes)
+
+			err := opts.checkLimits(plan, tt.inspected)
+			if open := errors.Is(err, ErrCircuitOpen); open != tt.open {
+				t.Errorf("checkLimits(%d, %d) = %v, want open %v", tt.changes, tt.inspected, err, tt.open)
+			}
+		})
+	}
+}
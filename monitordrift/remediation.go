@@ -0,0 +1,118 @@
+package monitordrift
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/awsclient"
+)
+
+// RemediationMode controls what monitorDrift is allowed to change
+// once it has found drift between DynamoDB and EC2.
+type RemediationMode string
+
+const (
+	// ModeReport only logs the planned changes
+	ModeReport RemediationMode = "report"
+
+	// ModeFixState updates the recorded status in DynamoDB
+	ModeFixState RemediationMode = "fix-state"
+
+	// ModeReconcile updates the recorded status and terminates
+	// orphaned instances that are no longer tracked
+	ModeReconcile RemediationMode = "reconcile"
+)
+
+// ErrCircuitOpen is returned when the planned changes exceed the
+// configured safety limits. No changes are made in that case.
+var ErrCircuitOpen = errors.New("drift circuit breaker open")
+
+// Options configures a drift run.
+type Options struct {
+	Mode RemediationMode
+
+	// MaxChanges is the maximum number of changes a single run may make
+	MaxChanges int
+
+	// MaxChangePercent is the maximum share of the inspected instances,
+	// as a percentage, that a single run may change
+	MaxChangePercent float64
+
+	// MinInspected is the number of inspected instances from which on
+	// MaxChangePercent applies. In smaller fleets a single change is a
+	// large share, so only MaxChanges limits them.
+	MinInspected int
+
+	// SweepRegions are the regions listed for orphaned instances. Empty
+	// sweeps the home region only.
+	SweepRegions []string
+
+	// OrphanGrace is how long after its launch an untracked instance is
+	// not yet an orphan
+	OrphanGrace time.Duration
+}
+
+// OptionsFromConfig returns the drift options of the service
+// configuration, which validated them at load time.
+func OptionsFromConfig(cfg *appconfig.Config) Options {
+	return Options{
+		Mode:             RemediationMode(cfg.DriftMode),
+		MaxChanges:       cfg.DriftMaxChanges,
+		MaxChangePercent: cfg.DriftMaxChangePercent,
+		MinInspected:     cfg.DriftMinInspected,
+		SweepRegions:     cfg.SweepRegions,
+		OrphanGrace:      cfg.DriftOrphanGrace,
+	}
+}
+
+// sweepRegions returns the regions to list for orphaned instances
+func (o Options) sweepRegions() []string {
+	if len(o.SweepRegions) == 0 {
+		return []string{awsclient.HomeRegion}
+	}
+	return o.SweepRegions
+}
+
+// changeKind is the kind of change planned by a drift run
+type changeKind string
+
+const (
+	changeStatus    changeKind = "update-status"
+	changeTerminate changeKind = "terminate-orphan"
+)
+
+// plannedChange is a single change a drift run intends to make
+type plannedChange struct {
+	Kind        changeKind
+	Region      string
+	ProvisionID string
+	InstanceID  string
+	From        string
+	To          string
+
+	// Team and VCPUs are returned to the quota when the change
+	// terminates a tracked instance
+	Team  string
+	VCPUs int
+}
+
+// checkLimits returns ErrCircuitOpen when the plan exceeds either the
+// absolute or the percentage limit. inspected is the number of instances
+// the plan was built from; the percentage limit applies from MinInspected
+// instances on.
+func (o Options) checkLimits(plan []plannedChange, inspected int) error {
+	if len(plan) > o.MaxChanges {
+		return fmt.Errorf("%w: %d planned changes exceed the limit of %d", ErrCircuitOpen, len(plan), o.MaxChanges)
+	}
+
+	if inspected > 0 && inspected >= o.MinInspected {
+		percent := float64(len(plan)) / float64(inspected) * 100
+		if percent > o.MaxChangePercent {
+			return fmt.Errorf("%w: %.1f%% of instances would change, limit is %.1f%%", ErrCircuitOpen, percent, o.MaxChangePercent)
+		}
+	}
+
+	return nil
+}
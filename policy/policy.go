@@ -0,0 +1,202 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Policy declares what a provision request may ask for in one
+// environment. Empty lists and a zero MaxTTLHours leave that part of the
+// request unrestricted. Instance types, AMI IDs and subnets are matched
+// as shell patterns, e.g. "t3.*" or "ami-0abc*". AMIOwners are account
+// IDs or owner aliases such as "amazon".
+type Policy struct {
+	AllowedInstanceTypes []string `json:"allowed_instance_types"`
+	AMIOwners            []string `json:"ami_owners"`
+	AMIPatterns          []string `json:"ami_patterns"`
+	AllowedSubnets       []string `json:"allowed_subnets"`
+	MaxTTLHours          int64    `json:"max_ttl_hours"`
+	RequiredTags         []string `json:"required_tags"`
+}
+
+// Request is the part of a provision request a policy is evaluated
+// against. AMIOwner is the account that owns the AMI and AMIOwnerAlias
+// its alias such as "amazon", both empty when they were not looked up.
+type Request struct {
+	InstanceType  string
+	AMI           string
+	AMIOwner      string
+	AMIOwnerAlias string
+	SubnetID      string
+	TTL           int64
+	Tags          map[string]string
+}
+
+// Violation is a single reason a request is rejected
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Rules reported in a Violation
+const (
+	RuleInstanceType = "allowed_instance_types"
+	RuleAMIOwner     = "ami_owners"
+	RuleAMIPattern   = "ami_patterns"
+	RuleSubnet       = "allowed_subnets"
+	RuleMaxTTL       = "max_ttl_hours"
+	RuleRequiredTag  = "required_tags"
+	RuleMissing      = "policy"
+)
+
+// Missing returns the violation reported when an environment has no
+// policy. Requests are denied by default, so an environment has to be
+// given a policy, even an empty one, before anything is provisioned.
+func Missing(env string) Violation {
+	return Violation{
+		Field:   "environment",
+		Rule:    RuleMissing,
+		Message: fmt.Sprintf("environment %q has no provision policy", env),
+	}
+}
+
+// Parse parses a single policy document
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// LoadFile reads a local policy file holding one policy per
+// environment, e.g. {"dev": {...}, "prod": {...}}
+func LoadFile(filename string) (map[string]*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", filename, err)
+	}
+
+	var policies map[string]*Policy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", filename, err)
+	}
+
+	for env, p := range policies {
+		if p == nil {
+			return nil, fmt.Errorf("policy of environment %q in %s is empty", env, filename)
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("policy of environment %q in %s: %w", env, filename, err)
+		}
+	}
+
+	return policies, nil
+}
+
+// validate reports malformed patterns, so they fail at load time rather
+// than silently matching nothing
+func (p *Policy) validate() error {
+	for _, patterns := range [][]string{p.AllowedInstanceTypes, p.AMIPatterns, p.AllowedSubnets} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	if p.MaxTTLHours < 0 {
+		return fmt.Errorf("max_ttl_hours must not be negative")
+	}
+	return nil
+}
+
+// Evaluate returns every rule of the policy the request violates. An
+// empty result means the request is allowed.
+func (p *Policy) Evaluate(req Request) []Violation {
+	var violations []Violation
+
+	if len(p.AllowedInstanceTypes) > 0 && !matchAny(p.AllowedInstanceTypes, req.InstanceType) {
+		violations = append(violations, Violation{
+			Field:   "ec2.instanceType",
+			Rule:    RuleInstanceType,
+			Message: fmt.Sprintf("instance type %q is not one of %s", req.InstanceType, strings.Join(p.AllowedInstanceTypes, ", ")),
+		})
+	}
+
+	if len(p.AMIOwners) > 0 && !contains(p.AMIOwners, req.AMIOwner) && !contains(p.AMIOwners, req.AMIOwnerAlias) {
+		violations = append(violations, Violation{
+			Field:   "ec2.ami",
+			Rule:    RuleAMIOwner,
+			Message: fmt.Sprintf("AMI %q is not owned by an allowed account", req.AMI),
+		})
+	}
+
+	if len(p.AMIPatterns) > 0 && !matchAny(p.AMIPatterns, req.AMI) {
+		violations = append(violations, Violation{
+			Field:   "ec2.ami",
+			Rule:    RuleAMIPattern,
+			Message: fmt.Sprintf("AMI %q does not match %s", req.AMI, strings.Join(p.AMIPatterns, ", ")),
+		})
+	}
+
+	if len(p.AllowedSubnets) > 0 && !matchAny(p.AllowedSubnets, req.SubnetID) {
+		violations = append(violations, Violation{
+			Field:   "ec2.subnet_id",
+			Rule:    RuleSubnet,
+			Message: fmt.Sprintf("subnet %q is not allowed in this environment", req.SubnetID),
+		})
+	}
+
+	if p.MaxTTLHours > 0 && req.TTL > p.MaxTTLHours {
+		violations = append(violations, Violation{
+			Field:   "ttl",
+			Rule:    RuleMaxTTL,
+			Message: fmt.Sprintf("ttl of %d hours exceeds the maximum of %d", req.TTL, p.MaxTTLHours),
+		})
+	}
+
+	for _, key := range p.RequiredTags {
+		if strings.TrimSpace(req.Tags[key]) == "" {
+			violations = append(violations, Violation{
+				Field:   "ec2.tags." + key,
+				Rule:    RuleRequiredTag,
+				Message: fmt.Sprintf("tag %q is required", key),
+			})
+		}
+	}
+
+	return violations
+}
+
+// NeedsAMIOwner reports whether evaluating the policy requires the owner
+// of the AMI to be looked up
+func (p *Policy) NeedsAMIOwner() bool {
+	return len(p.AMIOwners) > 0
+}
+
+// matchAny reports whether value matches one of the patterns
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether values holds the non-empty value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if value != "" && v == value {
+			return true
+		}
+	}
+	return false
+}
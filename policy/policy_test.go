@@ -0,0 +1,68 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	policy := &Policy{
+		AllowedInstanceTypes: []string{"t3.*", "m5.large"},
+		AMIOwners:            []string{"amazon", "123456789012"},
+		AMIPatterns:          []string{"ami-0abc*"},
+		AllowedSubnets:       []string{"subnet-1*"},
+		MaxTTLHours:          24,
+		RequiredTags:         []string{"Project"},
+	}
+	allowed := Request{
+		InstanceType:  "t3.micro",
+		AMI:           "ami-0abc123",
+		AMIOwnerAlias: "amazon",
+		SubnetID:      "subnet-123",
+		TTL:           24,
+		Tags:          map[string]string{"Project": "builder"},
+	}
+
+	tests := []struct {
+		name   string
+		policy *Policy
+		modify func(*Request)
+		want   []string
+	}{
+		{name: "allowed request", policy: policy, modify: func(*Request) {}},
+		{name: "empty policy allows anything", policy: &Policy{}, modify: func(r *Request) { *r = Request{InstanceType: "p4d.24xlarge", TTL: 1000} }},
+		{name: "instance type not allowed", policy: policy, modify: func(r *Request) { r.InstanceType = "p4d.24xlarge" }, want: []string{RuleInstanceType}},
+		{name: "exact instance type", policy: policy, modify: func(r *Request) { r.InstanceType = "m5.large" }},
+		{name: "owner account allowed", policy: policy, modify: func(r *Request) { r.AMIOwnerAlias, r.AMIOwner = "", "123456789012" }},
+		{name: "owner not allowed", policy: policy, modify: func(r *Request) { r.AMIOwnerAlias, r.AMIOwner = "", "999999999999" }, want: []string{RuleAMIOwner}},
+		{name: "owner unknown", policy: policy, modify: func(r *Request) { r.AMIOwnerAlias = "" }, want: []string{RuleAMIOwner}},
+		{name: "AMI pattern", policy: policy, modify: func(r *Request) { r.AMI = "ami-0def456" }, want: []string{RuleAMIPattern}},
+		{name: "subnet not allowed", policy: policy, modify: func(r *Request) { r.SubnetID = "subnet-999" }, want: []string{RuleSubnet}},
+		{name: "TTL over the maximum", policy: policy, modify: func(r *Request) { r.TTL = 25 }, want: []string{RuleMaxTTL}},
+		{name: "required tag missing", policy: policy, modify: func(r *Request) { r.Tags = nil }, want: []string{RuleRequiredTag}},
+		{name: "required tag blank", policy: policy, modify: func(r *Request) { r.Tags = map[string]string{"Project": " "} }, want: []string{RuleRequiredTag}},
+		{
+			name:   "every violation is reported",
+			policy: policy,
+			modify: func(r *Request) {
+				*r = Request{InstanceType: "c5.large", AMI: "ami-0def456", SubnetID: "subnet-999", TTL: 48}
+			},
+			want: []string{RuleInstanceType, RuleAMIOwner, RuleAMIPattern, RuleSubnet, RuleMaxTTL, RuleRequiredTag},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := allowed
+			tt.modify(&req)
+
+			var got []string
+			for _, v := range tt.policy.Evaluate(req) {
+				got = append(got, v.Rule)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Evaluate() rules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Limits are the quotas of a team. Zero means unlimited.
+type Limits struct {
+	MaxEnvironments int   `json:"max_environments"`
+	MaxVCPUs        int   `json:"max_vcpus"`
+	MaxTTLHours     int64 `json:"max_ttl_hours"`
+}
+
+// Names of the limits reported by ExceededError
+const (
+	LimitEnvironments = "max_environments"
+	LimitVCPUs        = "max_vcpus"
+	LimitTTL          = "max_ttl_hours"
+)
+
+// Usage is what a team currently has provisioned
+type Usage struct {
+	Environments int `json:"environments" dynamodbav:"environments"`
+	VCPUs        int `json:"vcpus" dynamodbav:"vcpus"`
+}
+
+// ExceededError is returned when a request would take a team over one of
+// its limits
+type ExceededError struct {
+	Team      string `json:"team"`
+	Limit     string `json:"limit"`
+	Max       int64  `json:"max"`
+	Current   int64  `json:"current"`
+	Requested int64  `json:"requested"`
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("team %q exceeds %s: %d in use, %d requested, limit is %d", e.Team, e.Limit, e.Current, e.Requested, e.Max)
+}
+
+// counterPrefix prefixes the ID of the usage counter items kept in the
+// tracking table. They carry no status, so the status queries and scans
+// of the tracking table never return them.
+const counterPrefix = "quota#"
+
+// counterKey returns the key of the usage counter of a team
+func counterKey(team string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"ID": &types.AttributeValueMemberS{Value: counterPrefix + team},
+	}
+}
+
+// CheckTTL returns an ExceededError when ttl is above the team's limit
+func CheckTTL(team string, limits Limits, ttl int64) error {
+	if limits.MaxTTLHours > 0 && ttl > limits.MaxTTLHours {
+		return &ExceededError{Team: team, Limit: LimitTTL, Max: limits.MaxTTLHours, Requested: ttl}
+	}
+	return nil
+}
+
+// Reserve counts one more environment with the given vCPUs against the
+// team. The counter is only updated when the result stays within the
+// limits, so concurrent requests cannot overshoot them. An ExceededError
+// names the limit that was hit.
+func Reserve(ctx context.Context, client *dynamodb.Client, tableName string, team string, limits Limits, vcpus int) error {
+	if limits.MaxVCPUs > 0 && vcpus > limits.MaxVCPUs {
+		return &ExceededError{Team: team, Limit: LimitVCPUs, Max: int64(limits.MaxVCPUs), Requested: int64(vcpus)}
+	}
+
+	values := map[string]types.AttributeValue{
+		":one":   &types.AttributeValueMemberN{Value: "1"},
+		":vcpus": &types.AttributeValueMemberN{Value: strconv.Itoa(vcpus)},
+		":team":  &types.AttributeValueMemberS{Value: team},
+	}
+
+	var conditions []string
+	if limits.MaxEnvironments > 0 {
+		conditions = append(conditions, "(attribute_not_exists(environments) OR environments < :max_environments)")
+		values[":max_environments"] = &types.AttributeValueMemberN{Value: strconv.Itoa(limits.MaxEnvironments)}
+	}
+	if limits.MaxVCPUs > 0 {
+		conditions = append(conditions, "(attribute_not_exists(vcpus) OR vcpus <= :max_vcpus)")
+		values[":max_vcpus"] = &types.AttributeValueMemberN{Value: strconv.Itoa(limits.MaxVCPUs - vcpus)}
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(tableName),
+		Key:                                 counterKey(team),
+		UpdateExpression:                    aws.String("ADD environments :one, vcpus :vcpus SET team = :team"),
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+	if len(conditions) > 0 {
+		input.ConditionExpression = aws.String(strings.Join(conditions, " AND "))
+	}
+
+	_, err := client.UpdateItem(ctx, input)
+
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		var usage Usage
+		if err := attributevalue.UnmarshalMap(failed.Item, &usage); err != nil {
+			return fmt.Errorf("failed to unmarshal quota usage: %w", err)
+		}
+		return exceeded(team, limits, usage, vcpus)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reserve quota: %w", err)
+	}
+
+	return nil
+}
+
+// exceeded returns the error for the limit usage hit
+func exceeded(team string, limits Limits, usage Usage, vcpus int) *ExceededError {
+	if limits.MaxEnvironments > 0 && usage.Environments >= limits.MaxEnvironments {
+		return &ExceededError{Team: team, Limit: LimitEnvironments, Max: int64(limits.MaxEnvironments), Current: int64(usage.Environments), Requested: 1}
+	}
+	return &ExceededError{Team: team, Limit: LimitVCPUs, Max: int64(limits.MaxVCPUs), Current: int64(usage.VCPUs), Requested: int64(vcpus)}
+}
+
+// Release returns an environment and its vCPUs to the team, e.g. when
+// the launch it was reserved for failed
+func Release(ctx context.Context, client *dynamodb.Client, tableName string, team string, vcpus int) error {
+	update := ReleaseUpdate(tableName, team, vcpus)
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release quota: %w", err)
+	}
+
+	return nil
+}
+
+// ReleaseUpdate returns the update that releases an environment, for use
+// in a transaction with the status change that ends it
+func ReleaseUpdate(tableName string, team string, vcpus int) *types.Update {
+	return &types.Update{
+		TableName:        aws.String(tableName),
+		Key:              counterKey(team),
+		UpdateExpression: aws.String("ADD environments :minus_one, vcpus :minus_vcpus"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":minus_one":   &types.AttributeValueMemberN{Value: "-1"},
+			":minus_vcpus": &types.AttributeValueMemberN{Value: strconv.Itoa(-vcpus)},
+		},
+	}
+}
+
+var (
+	vcpuMu    sync.Mutex
+	vcpuCache = make(map[string]int)
+)
+
+// VCPUs returns the default vCPU count of an instance type. Counts are
+// cached for the life of the process.
+func VCPUs(ctx context.Context, client *ec2.Client, instanceType string) (int, error) {
+	vcpuMu.Lock()
+	count, ok := vcpuCache[instanceType]
+	vcpuMu.Unlock()
+	if ok {
+		return count, nil
+	}
+
+	result, err := client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []ec2Types.InstanceType{ec2Types.InstanceType(instanceType)},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to describe instance type %s: %w", instanceType, err)
+	}
+	if len(result.InstanceTypes) == 0 || result.InstanceTypes[0].VCpuInfo == nil {
+		return 0, fmt.Errorf("unknown instance type %s", instanceType)
+	}
+
+	count = int(aws.Int32Value(result.InstanceTypes[0].VCpuInfo.DefaultVCpus))
+
+	vcpuMu.Lock()
+	vcpuCache[instanceType] = count
+	vcpuMu.Unlock()
+
+	return count, nil
+}
@@ -0,0 +1,207 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mask replaces redacted values
+const Mask = "[REDACTED]"
+
+// defaultFields are the field names whose values are always masked
+var defaultFields = []string{
+	"password",
+	"secret",
+	"token",
+	"authorization",
+	"private_key",
+	"key_material",
+	"key_name",
+	"user_data",
+	"bootstrap",
+}
+
+// rule is a pattern and its replacement
+type rule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// defaultRules mask secrets that can appear inside free-form text
+var defaultRules = []rule{
+	// PEM encoded private keys
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), Mask},
+
+	// AWS access key IDs
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), Mask},
+
+	// Bearer tokens
+	{regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`), "Bearer " + Mask},
+
+	// key=value and "key": "value" pairs of secret looking keys
+	{regexp.MustCompile(`(?i)\b((?:password|secret|token|api[_-]?key)["']?\s*[:=]\s*["']?)[^\s"',&]+`), "${1}" + Mask},
+
+	// Account IDs inside ARNs
+	{regexp.MustCompile(`\b(arn:aws[a-zA-Z-]*:[a-z0-9-]*:[a-z0-9-]*:)\d{12}\b`), "${1}************"},
+}
+
+// Redactor masks configured field names and patterns
+type Redactor struct {
+	fields map[string]bool
+	rules  []rule
+}
+
+// New returns a Redactor masking the default fields and patterns plus
+// the given field names and patterns. Field names are matched without
+// regard to case. A pattern that does not compile is an error, rather
+// than leaving what it was meant to mask in the clear.
+func New(fields []string, patterns []string) (*Redactor, error) {
+	r := &Redactor{
+		fields: make(map[string]bool),
+		rules:  append([]rule{}, defaultRules...),
+	}
+
+	for _, f := range append(append([]string{}, defaultFields...), fields...) {
+		if f = strings.TrimSpace(f); f != "" {
+			r.fields[strings.ToLower(f)] = true
+		}
+	}
+
+	for _, p := range patterns {
+		if p == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", p, err)
+		}
+		r.rules = append(r.rules, rule{re: re, repl: Mask})
+	}
+
+	return r, nil
+}
+
+var (
+	defaultMu sync.RWMutex
+
+	// The default patterns always compile
+	defaultRedactor, _ = New(nil, nil)
+)
+
+// Configure replaces the process-wide Redactor with one masking the
+// given field names and patterns on top of the defaults
+func Configure(fields []string, patterns []string) error {
+	r, err := New(fields, patterns)
+	if err != nil {
+		return err
+	}
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultRedactor = r
+	return nil
+}
+
+// Default returns the process-wide Redactor
+func Default() *Redactor {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	return defaultRedactor
+}
+
+// IsSensitive reports whether values of the named field are masked
+func (r *Redactor) IsSensitive(field string) bool {
+	return r.fields[strings.ToLower(field)]
+}
+
+// String masks every pattern match in s
+func (r *Redactor) String(s string) string {
+	for _, rule := range r.rules {
+		s = rule.re.ReplaceAllString(s, rule.repl)
+	}
+	return s
+}
+
+// Error returns err with its text masked, nil for a nil err. The result
+// no longer wraps err.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(r.String(err.Error()))
+}
+
+// Field returns the value to emit for the named field: the mask for a
+// sensitive field, the masked text for strings and errors, a masked copy
+// for structs, maps and slices, and the value itself otherwise.
+func (r *Redactor) Field(field string, value any) any {
+	if r.IsSensitive(field) {
+		return Mask
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return r.String(v)
+	case error:
+		return r.String(v.Error())
+	}
+
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Pointer, reflect.Interface:
+		return r.composite(value)
+	default:
+		return value
+	}
+}
+
+// composite masks a composite value through its JSON form, so nested
+// field names are matched as they appear in the log entry
+func (r *Redactor) composite(value any) any {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return r.String(fmt.Sprint(value))
+	}
+
+	var decoded any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return r.String(string(data))
+	}
+	return r.walk(decoded)
+}
+
+// walk masks the sensitive fields and the pattern matches of a decoded
+// JSON value in place
+func (r *Redactor) walk(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if r.IsSensitive(k) {
+				v[k] = Mask
+			} else {
+				v[k] = r.walk(e)
+			}
+		}
+		return v
+	case []any:
+		for i, e := range v {
+			v[i] = r.walk(e)
+		}
+		return v
+	case string:
+		return r.String(v)
+	default:
+		return v
+	}
+}
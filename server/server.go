@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/30Piraten/aws-dynamicEventBuilder/appconfig"
+	"github.com/30Piraten/aws-dynamicEventBuilder/audit"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/lifecycleenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/lambda-functions/provisionenv"
+	"github.com/30Piraten/aws-dynamicEventBuilder/logging"
+	"github.com/30Piraten/aws-dynamicEventBuilder/metrics"
+	"github.com/30Piraten/aws-dynamicEventBuilder/monitordrift"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// ListenAndServe runs the service as a long-lived local server on
+// cfg.LocalAddr. Provision requests are served on /provision, the
+// Prometheus metrics on /metrics, the audit history on /history and
+// teardown, extend and pin on /lifecycle. When a drift interval is
+// configured the drift check runs on that interval.
+func ListenAndServe(cfg *appconfig.Config) error {
+	if cfg.DriftInterval > 0 {
+		go runDrift(cfg)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.PrometheusHandler())
+	mux.HandleFunc("/provision", serve(provisionenv.NewProvisionHandler(cfg)))
+	mux.HandleFunc("/history", serve(audit.NewHistoryHandler(cfg)))
+	mux.HandleFunc("/lifecycle", serve(lifecycleenv.NewLifecycleHandler(cfg)))
+
+	logging.Info(context.Background(), "Local server listening", logging.Fields{"addr": cfg.LocalAddr})
+	return http.ListenAndServe(cfg.LocalAddr, mux)
+}
+
+// proxyHandler is the signature of the API Gateway handlers
+type proxyHandler func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error)
+
+// serve adapts an API Gateway handler to an HTTP handler
+func serve(handler proxyHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		resp, err := handler(r.Context(), toProxyRequest(r, body))
+		if err != nil {
+			logging.Error(r.Context(), "Request failed", err, logging.Fields{"path": r.URL.Path})
+		}
+
+		for k, v := range resp.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.WriteString(w, resp.Body)
+	}
+}
+
+// toProxyRequest converts an HTTP request to the payload format 2.0 event
+// the HTTP API sends
+func toProxyRequest(r *http.Request, body []byte) events.APIGatewayV2HTTPRequest {
+	headers := make(map[string]string, len(r.Header))
+	for k := range r.Header {
+		headers[k] = r.Header.Get(k)
+	}
+
+	query := make(map[string]string, len(r.URL.Query()))
+	for k := range r.URL.Query() {
+		query[k] = r.URL.Query().Get(k)
+	}
+
+	return events.APIGatewayV2HTTPRequest{
+		Version:               "2.0",
+		RawPath:               r.URL.Path,
+		RawQueryString:        r.URL.RawQuery,
+		Headers:               headers,
+		QueryStringParameters: query,
+		Body:                  string(body),
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RequestID:  requestID(r),
+			TimeEpoch:  time.Now().UnixMilli(),
+			Authorizer: localIdentity(r),
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method: r.Method,
+				Path:   r.URL.Path,
+			},
+		},
+	}
+}
+
+// localIdentity stands in for an authorizer: the caller is taken from the
+// X-Caller header and its groups from the comma separated X-Caller-Groups.
+// The local server is not meant to be exposed, so the headers are trusted.
+func localIdentity(r *http.Request) *events.APIGatewayV2HTTPRequestContextAuthorizerDescription {
+	caller := r.Header.Get("X-Caller")
+	if caller == "" {
+		return nil
+	}
+	return &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+		Lambda: map[string]any{
+			"principalId": caller,
+			"groups":      r.Header.Get("X-Caller-Groups"),
+		},
+	}
+}
+
+// requestID returns the caller supplied X-Request-Id, or a new ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return uuid.New().String()
+}
+
+// runDrift runs the drift check every configured interval
+func runDrift(cfg *appconfig.Config) {
+	handler := monitordrift.NewDriftHandler(cfg)
+
+	ticker := time.NewTicker(cfg.DriftInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		if err := handler(ctx, events.CloudWatchEvent{}); err != nil {
+			logging.Error(ctx, "Drift check failed", err, logging.Fields{logging.Environment: cfg.Environment})
+		}
+	}
+}
@@ -35,6 +35,28 @@ variable "ttl_hours" {
 }
 
 // SSM VARIABLE DECLARATION
+variable "jwt_issuer" {
+  description = "Issuer of the JWTs the API accepts, e.g. https://cognito-idp.<region>.amazonaws.com/<user pool ID>"
+  type        = string
+}
+
+variable "jwt_audience" {
+  description = "Audiences (app client IDs) the API accepts JWTs for"
+  type        = list(string)
+}
+
+variable "instance_profile_role_arns" {
+  description = "ARNs of the roles of the instance profiles environments may be launched with"
+  type        = list(string)
+  default     = []
+}
+
+variable "provision_policy" {
+  description = "Provision policy of the environment, set per environment in env/*.tfvars"
+  type        = any
+  default     = null
+}
+
 variable "table-type" {
   type        = string
   default     = "env-tracker"